@@ -1,4 +1,4 @@
-import { type ErrorDetails } from "./.generated/types";
+import { type Breadcrumb, type ErrorDetails } from "./.generated/types";
 
 declare const REPORTING_ENDPOINT: string;
 
@@ -13,6 +13,97 @@ declare const REPORTING_ENDPOINT: string;
   if (token === null) {
     throw new Error("ShadowWatcher: Token is not defined.");
   }
+  // The build and environment of the page, e.g. data-release="1.4.2" data-environment="production"
+  const release: string | undefined = self.getAttribute("data-release") || undefined;
+  const environment: string | undefined = self.getAttribute("data-environment") || undefined;
+
+  /**
+   * Records what happened on the page so errors can be sent with the steps that led to them.
+   */
+  const MAX_BREADCRUMBS = 100;
+  const breadcrumbs: Breadcrumb[] = [];
+
+  function addBreadcrumb(category: string, message: string, level = "info", data?: { [key: string]: any }) {
+    breadcrumbs.push({ timestamp: new Date().toISOString(), category, message, level, data });
+    if (breadcrumbs.length > MAX_BREADCRUMBS) {
+      breadcrumbs.shift();
+    }
+  }
+
+  /**
+   * Describes a clicked element as a short CSS-like selector.
+   */
+  function describeElement(element: Element): string {
+    let description = element.tagName.toLowerCase();
+    if (element.id) {
+      description += "#" + element.id;
+    }
+    for (const className of Array.from(element.classList).slice(0, 3)) {
+      description += "." + className;
+    }
+    return description;
+  }
+
+  function watchBreadcrumbs(reportingEndpoint: string) {
+    w.document.addEventListener("click", (event) => {
+      if (event.target instanceof Element) {
+        addBreadcrumb("ui.click", describeElement(event.target));
+      }
+    }, true);
+
+    // Single page apps navigate through the history API
+    let lastURL = w.location.href;
+    const navigated = () => {
+      const url = w.location.href;
+      if (url !== lastURL) {
+        addBreadcrumb("navigation", lastURL + " -> " + url, "info", { from: lastURL, to: url });
+        lastURL = url;
+      }
+    };
+    for (const method of ["pushState", "replaceState"] as const) {
+      const original = w.history[method];
+      w.history[method] = function (this: History, ...args: Parameters<History["pushState"]>) {
+        const result = original.apply(this, args);
+        navigated();
+        return result;
+      };
+    }
+    w.addEventListener("popstate", navigated);
+
+    const originalFetch = w.fetch;
+    w.fetch = async function (input: RequestInfo | URL, init?: RequestInit) {
+      const method = (init?.method || (input instanceof Request ? input.method : "GET")).toUpperCase();
+      const url = input instanceof Request ? input.url : String(input);
+      if (url.startsWith(reportingEndpoint)) {
+        return originalFetch(input, init);
+      }
+      try {
+        const response = await originalFetch(input, init);
+        addBreadcrumb("fetch", method + " " + url, response.ok ? "info" : "error", { method, url, status: response.status });
+        return response;
+      } catch (error) {
+        addBreadcrumb("fetch", method + " " + url, "error", { method, url, error: String(error) });
+        throw error;
+      }
+    };
+
+    const originalOpen = XMLHttpRequest.prototype.open;
+    XMLHttpRequest.prototype.open = function (this: XMLHttpRequest, method: string, url: string | URL, ...rest: any[]) {
+      this.addEventListener("loadend", () => {
+        const status = this.status;
+        addBreadcrumb("xhr", method.toUpperCase() + " " + url, status >= 200 && status < 400 ? "info" : "error", { method: method.toUpperCase(), url: String(url), status });
+      });
+      return (originalOpen as Function).call(this, method, url, ...rest);
+    } as typeof XMLHttpRequest.prototype.open;
+
+    for (const level of ["warn", "error"] as const) {
+      const original = console[level];
+      console[level] = (...args: any[]) => {
+        addBreadcrumb("console", args.map((arg) => String(arg)).join(" "), level);
+        original.apply(console, args);
+      };
+    }
+  }
 
   /**
    * This is the controller class for the client. It is used to watch for errors and send them to the server.
@@ -102,6 +193,9 @@ declare const REPORTING_ENDPOINT: string;
         datetime: new Date().toISOString(),
         userAgent: navigator.userAgent,
         stackTrace,
+        release,
+        environment,
+        breadcrumbs: breadcrumbs.slice(),
       };
       console.log(details);
       this.sendLog(details);
@@ -113,6 +207,8 @@ declare const REPORTING_ENDPOINT: string;
     REPORTING_ENDPOINT + '/api/report-error'
   );
 
+  watchBreadcrumbs(REPORTING_ENDPOINT);
+
   onerror = (message, source, lineno, colno, error) => {
     console.log(w.URL.toString());
     shadowWatcher.handleError(
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tjseabury/overlord/sourcemap"
+	"tjseabury/overlord/stacktrace"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// The largest source map accepted by the upload endpoint
+const maxArtifactSize = 50 << 20
+
+// The number of parsed source maps kept in memory
+const sourceMapCacheSize = 64
+
+// Artifact is a source map uploaded for a release of a web property. Name is
+// the URL of the minified file the map belongs to, either in full or as
+// "~/path/to/file.js" to match the path on any host.
+type Artifact struct {
+	ID            uint      `gorm:"primarykey" json:"id"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+	WebPropertyID uint      `gorm:"not null;uniqueIndex:idx_artifact_name" json:"webPropertyId"`
+	Release       string    `gorm:"size:255;not null;uniqueIndex:idx_artifact_name" json:"release"`
+	Name          string    `gorm:"size:2048;not null;uniqueIndex:idx_artifact_name" json:"name"`
+	Path          string    `gorm:"not null" json:"-"`
+	Size          int64     `gorm:"not null" json:"size"`
+}
+
+// artifactNames lists the artifact names that may hold the source map of a
+// frame's file, most specific first.
+func artifactNames(filename string) []string {
+	names := []string{filename}
+	if u, err := url.Parse(filename); err == nil && u.Host != "" {
+		names = append(names, "~"+u.Path)
+	}
+	return names
+}
+
+// Symbolicator rewrites minified stack frames to their original source
+// using uploaded source maps.
+type Symbolicator struct {
+	DB  *gorm.DB
+	Dir string
+
+	mu    sync.Mutex
+	cache map[uint]*sourcemap.Map
+}
+
+func newSymbolicator(db *gorm.DB, dir string) *Symbolicator {
+	return &Symbolicator{
+		DB:    db,
+		Dir:   dir,
+		cache: make(map[uint]*sourcemap.Map),
+	}
+}
+
+// findArtifact returns the artifact holding the source map of a file, if
+// one was uploaded.
+func (s *Symbolicator) findArtifact(propertyID uint, release, filename string) (Artifact, bool) {
+	for _, name := range artifactNames(filename) {
+		var artifact Artifact
+		s.DB.Where("web_property_id = ? AND release = ? AND name = ?", propertyID, release, name).First(&artifact)
+		if artifact.ID != 0 {
+			return artifact, true
+		}
+	}
+	return Artifact{}, false
+}
+
+func (s *Symbolicator) load(artifact Artifact) (*sourcemap.Map, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m, ok := s.cache[artifact.ID]; ok {
+		return m, nil
+	}
+
+	data, err := os.ReadFile(artifact.Path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := sourcemap.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start over rather than track usage; maps are cheap to reload
+	if len(s.cache) >= sourceMapCacheSize {
+		s.cache = make(map[uint]*sourcemap.Map)
+	}
+	s.cache[artifact.ID] = m
+	return m, nil
+}
+
+func (s *Symbolicator) evict(artifactID uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.cache, artifactID)
+}
+
+// Symbolicate rewrites every frame that has a source map to its original
+// position, keeping the minified frame alongside.
+func (s *Symbolicator) Symbolicate(propertyID uint, release string, frames []StackFrame) {
+	maps := make(map[string]*sourcemap.Map)
+	for i := range frames {
+		frame := &frames[i]
+		if frame.Line == 0 || frame.Filename == "" {
+			continue
+		}
+
+		m, seen := maps[frame.Filename]
+		if !seen {
+			if artifact, ok := s.findArtifact(propertyID, release, frame.Filename); ok {
+				var err error
+				if m, err = s.load(artifact); err != nil {
+					log.Println("Error loading source map:", err)
+				}
+			}
+			maps[frame.Filename] = m
+		}
+		if m == nil {
+			continue
+		}
+
+		mapping, ok := m.Lookup(frame.Line, frame.Column)
+		if !ok {
+			continue
+		}
+		frame.Minified = frame.Frame
+		frame.Symbolicated = true
+		frame.Filename = mapping.Source
+		frame.Line = mapping.Line
+		frame.Column = mapping.Column
+		if mapping.Name != "" {
+			frame.Function = mapping.Name
+		}
+		frame.InApp = stacktrace.IsInApp(mapping.Source)
+	}
+}
+
+func (router *Router) api_upload_artifact(w http.ResponseWriter, r *http.Request) {
+	property, ok := router.webPropertyFromPath(w, r)
+	if !ok {
+		return
+	}
+	release := r.PathValue("release")
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxArtifactSize)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "A source map file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Error reading source map", http.StatusBadRequest)
+		return
+	}
+	if _, err := sourcemap.Parse(data); err != nil {
+		http.Error(w, "Invalid source map: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	dir := filepath.Join(router.Symbolicator.Dir, strconv.Itoa(int(property.ID)))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		http.Error(w, "Error storing source map", http.StatusInternalServerError)
+		return
+	}
+	path := filepath.Join(dir, uuid.NewString()+".map")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		http.Error(w, "Error storing source map", http.StatusInternalServerError)
+		return
+	}
+
+	// Uploading the same name again replaces the earlier map
+	var artifact Artifact
+	router.DB.Where("web_property_id = ? AND release = ? AND name = ?", property.ID, release, name).First(&artifact)
+	replaced := artifact.Path
+	artifact.WebPropertyID = property.ID
+	artifact.Release = release
+	artifact.Name = name
+	artifact.Path = path
+	artifact.Size = int64(len(data))
+	if err := router.DB.Save(&artifact).Error; err != nil {
+		os.Remove(path)
+		http.Error(w, "Error storing source map", http.StatusInternalServerError)
+		return
+	}
+	// The earlier map is only removed once nothing points at it
+	if replaced != "" {
+		os.Remove(replaced)
+		router.Symbolicator.evict(artifact.ID)
+	}
+
+	writeJSON(w, http.StatusCreated, artifact)
+}
+
+func (router *Router) api_list_artifacts(w http.ResponseWriter, r *http.Request) {
+	property, ok := router.webPropertyFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	artifacts := make([]Artifact, 0)
+	router.DB.Where("web_property_id = ? AND release = ?", property.ID, r.PathValue("release")).Order("name").Find(&artifacts)
+	writeJSON(w, http.StatusOK, artifacts)
+}
+
+func (router *Router) api_delete_artifact(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid artifact ID", http.StatusBadRequest)
+		return
+	}
+
+	var artifact Artifact
+	err = router.DB.First(&artifact, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Artifact not found", http.StatusNotFound)
+		return
+	}
+	if err := router.DB.Delete(&artifact).Error; err != nil {
+		http.Error(w, "Error deleting artifact", http.StatusInternalServerError)
+		return
+	}
+	os.Remove(artifact.Path)
+	router.Symbolicator.evict(artifact.ID)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{\"message\": \"Success\"}"))
+}
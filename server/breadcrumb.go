@@ -0,0 +1,29 @@
+package main
+
+import (
+	"tjseabury/overlord/types"
+)
+
+// EventBreadcrumb is a stored breadcrumb of an event. Position 0 is the
+// oldest breadcrumb.
+type EventBreadcrumb struct {
+	ID       uint `gorm:"primarykey" json:"id"`
+	EventID  int  `gorm:"not null;index" json:"eventId"`
+	Position int  `gorm:"not null" json:"position"`
+	types.Breadcrumb
+}
+
+// breadcrumbsFor builds the breadcrumb table rows of an event.
+func breadcrumbsFor(breadcrumbs []types.Breadcrumb) []EventBreadcrumb {
+	rows := make([]EventBreadcrumb, len(breadcrumbs))
+	for i, breadcrumb := range breadcrumbs {
+		rows[i] = EventBreadcrumb{Position: i, Breadcrumb: breadcrumb}
+	}
+	return rows
+}
+
+func (ec *EventController) ListBreadcrumbs(eventID int) []EventBreadcrumb {
+	breadcrumbs := make([]EventBreadcrumb, 0)
+	ec.DB.Where("event_id = ?", eventID).Order("position").Find(&breadcrumbs)
+	return breadcrumbs
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"log"
+	"strconv"
+)
+
+// configInt reads an integer setting from the .env file, falling back to a
+// default when it is missing or malformed.
+func configInt(key string, fallback int) int {
+	raw, ok := APP_CONFIG[key]
+	if !ok || raw == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using %d", key, raw, fallback)
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OutcomeOriginForbidden counts events sent from an origin that is not in
+// the property's allowlist
+const OutcomeOriginForbidden = "origin_forbidden"
+
+// How long browsers may cache a preflight response, in seconds
+const preflightMaxAge = "86400"
+
+// normalizeOrigin lowercases an origin and strips default ports, returning
+// "" if it is not a valid http(s) origin.
+func normalizeOrigin(origin string) string {
+	u, err := url.Parse(strings.TrimSpace(origin))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	return u.Scheme + "://" + host
+}
+
+// AllowsOrigin reports whether browsers on the given origin may report
+// events to this property. Entries are origins such as
+// "https://example.com"; "https://*.example.com" matches any subdomain and
+// "*" matches everything. A property with no allowed origins accepts any.
+func (p *WebProperty) AllowsOrigin(origin string) bool {
+	if len(p.AllowedOrigins) == 0 {
+		return true
+	}
+	origin = normalizeOrigin(origin)
+	if origin == "" {
+		return false
+	}
+	for _, allowed := range p.AllowedOrigins {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" {
+			return true
+		}
+		scheme, host, ok := strings.Cut(strings.ToLower(allowed), "://*.")
+		if ok {
+			// "https://*.example.com" matches "https://www.example.com"
+			if strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(origin, "."+host) {
+				return true
+			}
+			continue
+		}
+		if normalizeOrigin(allowed) == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// setReportingCORSHeaders lets a browser on origin read the response of an
+// ingestion request.
+func setReportingCORSHeaders(w http.ResponseWriter, origin string) {
+	w.Header().Add("Vary", "Origin")
+	if origin == "" {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Encoding, X-ACCESS-TOKEN, X-Sentry-Auth")
+	w.Header().Set("Access-Control-Max-Age", preflightMaxAge)
+}
+
+// admitOrigin rejects ingestion requests from browsers on origins the
+// property does not allow. Requests without an Origin header, such as those
+// from servers, are always admitted.
+func (router *Router) admitOrigin(w http.ResponseWriter, r *http.Request, property *WebProperty) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if !property.AllowsOrigin(origin) {
+		recordOutcome(router.DB, property.ID, OutcomeOriginForbidden, 1)
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return false
+	}
+	setReportingCORSHeaders(w, origin)
+	return true
+}
+
+// api_report_error_preflight answers CORS preflight requests for the
+// ingestion endpoints. Browsers do not send the ingestion token with a
+// preflight, so the origin is echoed back if any property allows it; the
+// request itself is then checked against its own property.
+func (router *Router) api_report_error_preflight(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		http.Error(w, "Origin is required", http.StatusBadRequest)
+		return
+	}
+
+	for _, property := range router.WebPropertyDB.ListWebProperties() {
+		if property.AllowsOrigin(origin) {
+			setReportingCORSHeaders(w, origin)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	w.Header().Add("Vary", "Origin")
+	http.Error(w, "Origin not allowed", http.StatusForbidden)
+}
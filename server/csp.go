@@ -0,0 +1,99 @@
+package main
+
+import (
+	"cmp"
+	"net/url"
+	"strings"
+
+	"tjseabury/overlord/types"
+)
+
+// Pages using report-uri send violations as application/csp-report:
+//
+//	Content-Security-Policy: ...; report-uri https://<overlord host>/api/csp-report/<token>
+//
+// which are read like the csp-violation reports of the Reporting API.
+
+// The Reporting API names of the fields of a report-uri body
+var cspReportFields = map[string]string{
+	"document-uri":        "documentURL",
+	"referrer":            "referrer",
+	"blocked-uri":         "blockedURL",
+	"violated-directive":  "violatedDirective",
+	"effective-directive": "effectiveDirective",
+	"original-policy":     "originalPolicy",
+	"disposition":         "disposition",
+	"source-file":         "sourceFile",
+	"line-number":         "lineNumber",
+	"column-number":       "columnNumber",
+	"status-code":         "statusCode",
+	"script-sample":       "sample",
+}
+
+// What browsers report as the blocked URI of resources that are not URLs
+var cspKeywords = map[string]string{
+	"":                     "'inline'",
+	"inline":               "'inline'",
+	"eval":                 "'eval'",
+	"wasm-eval":            "'wasm-eval'",
+	"self":                 "'self'",
+	"trusted-types-policy": "'trusted-types-policy'",
+	"trusted-types-sink":   "'trusted-types-sink'",
+	"data":                 "data:",
+	"blob":                 "blob:",
+}
+
+// cspReport turns the body of a report-uri request into a Reporting API
+// report.
+func cspReport(legacy map[string]any) browserReport {
+	report := browserReport{Type: types.EventTypeCSPViolation, Body: make(map[string]any)}
+	for key, value := range legacy {
+		report.Body[cmp.Or(cspReportFields[key], key)] = value
+	}
+	report.URL = report.text("documentURL")
+	return report
+}
+
+// cspViolation is what a violation is grouped and searched by.
+type cspViolation struct {
+	DocumentURL string
+	Directive   string
+	Blocked     string
+	Disposition string
+}
+
+// blockedOrigin reduces a blocked URI to the origin it was loaded from, or
+// to the scheme or keyword of resources without one, so that violations of
+// every script on a CDN are grouped together.
+func blockedOrigin(blocked string) string {
+	blocked = strings.TrimSpace(blocked)
+	if keyword, ok := cspKeywords[strings.ToLower(blocked)]; ok {
+		return keyword
+	}
+	u, err := url.Parse(blocked)
+	if err != nil || u.Scheme == "" {
+		return blocked
+	}
+	if u.Host == "" {
+		return strings.ToLower(u.Scheme) + ":"
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// normalizeCSPViolation picks the directive and blocked origin of a
+// violation. Older browsers only report the violated directive, sometimes
+// with its whole source list.
+func normalizeCSPViolation(report *browserReport) cspViolation {
+	directive := report.text("effectiveDirective")
+	if directive == "" {
+		if fields := strings.Fields(report.text("violatedDirective")); len(fields) > 0 {
+			directive = fields[0]
+		}
+	}
+	return cspViolation{
+		DocumentURL: report.text("documentURL"),
+		Directive:   strings.ToLower(strings.TrimSpace(directive)),
+		Blocked:     blockedOrigin(report.text("blockedURL")),
+		Disposition: strings.ToLower(report.text("disposition")),
+	}
+}
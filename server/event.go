@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"tjseabury/overlord/stacktrace"
+	"tjseabury/overlord/types"
+
+	"gorm.io/gorm"
+)
+
+// ErrorDetailsModel is a stored event: the payload as it was accepted, with
+// what the server added to it.
+type ErrorDetailsModel struct {
+	ID        int            `gorm:"primaryKey" json:"id" tstype:"number|null"`
+	CreatedAt time.Time      `json:"created_at" tstype:"string|null"`
+	UpdatedAt time.Time      `json:"updated_at" tstype:"string|null"`
+	DeletedAt gorm.DeletedAt `gorm:"index" tstype:"null|string"`
+	types.ErrorDetails
+	WebPropertyID int `gorm:"not null;index" json:"web_property_id" tstype:"number|null"`
+	IssueID       int `gorm:"index" json:"issue_id" tstype:"number|null"`
+	// Set when a field was cut to the server's length limits
+	Truncated bool `gorm:"not null;default:false" json:"truncated"`
+	// The fraction of similar events that were kept when this one was
+	// sampled, so counts can be extrapolated
+	SampleRate float64 `gorm:"not null;default:1" json:"sample_rate"`
+	// Parsed from UserAgent when the event was ingested
+	BrowserName    string `gorm:"size:64;index" json:"browser_name"`
+	BrowserVersion string `gorm:"size:32;index" json:"browser_version"`
+	OSName         string `gorm:"size:64;index" json:"os_name"`
+	OSVersion      string `gorm:"size:32;index" json:"os_version"`
+	DeviceType     string `gorm:"size:16;index" json:"device_type"`
+	Bot            bool   `gorm:"not null;default:false;index" json:"bot"`
+	// The names of the scrubbing rules that masked part of this event
+	ScrubbedRules []string `gorm:"serializer:json" json:"scrubbed_rules"`
+}
+
+// StackFrame is a parsed frame of an event's stack trace. Position 0 is the
+// innermost frame. When a source map rewrote the frame, the frame as
+// reported by the browser is kept in Minified.
+type StackFrame struct {
+	ID       uint `gorm:"primarykey" json:"id"`
+	EventID  int  `gorm:"not null;index" json:"eventId"`
+	Position int  `gorm:"not null" json:"position"`
+	stacktrace.Frame
+	Symbolicated bool             `gorm:"not null;default:false" json:"symbolicated"`
+	Minified     stacktrace.Frame `gorm:"embedded;embeddedPrefix:minified_" json:"minified"`
+}
+
+// framesFor builds the frames table rows of an event from parsed frames.
+func framesFor(frames []stacktrace.Frame) []StackFrame {
+	rows := make([]StackFrame, len(frames))
+	for i, frame := range frames {
+		rows[i] = StackFrame{Position: i, Frame: frame}
+	}
+	return rows
+}
+
+// EventFilter narrows events, and the issues they belong to, down to those
+// matching every field that is set.
+type EventFilter struct {
+	WebPropertyID  uint   `json:"webPropertyId,omitempty"`
+	IssueID        uint   `json:"issueId,omitempty"`
+	Type           string `json:"type,omitempty"`
+	Browser        string `json:"browser,omitempty"`
+	BrowserVersion string `json:"browserVersion,omitempty"`
+	OS             string `json:"os,omitempty"`
+	OSVersion      string `json:"osVersion,omitempty"`
+	DeviceType     string `json:"device,omitempty"`
+	Bot            *bool  `json:"bot,omitempty"`
+	Release        string `json:"release,omitempty"`
+	Environment    string `json:"environment,omitempty"`
+	// Events must have every one of these tags
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+func eventFilterFromQuery(query url.Values) EventFilter {
+	propertyID, _ := strconv.ParseUint(query.Get("webPropertyId"), 10, 64)
+	issueID, _ := strconv.ParseUint(query.Get("issueId"), 10, 64)
+	filter := EventFilter{
+		WebPropertyID:  uint(propertyID),
+		IssueID:        uint(issueID),
+		Type:           query.Get("type"),
+		Browser:        query.Get("browser"),
+		BrowserVersion: query.Get("browserVersion"),
+		OS:             query.Get("os"),
+		OSVersion:      query.Get("osVersion"),
+		DeviceType:     query.Get("device"),
+		Release:        query.Get("release"),
+		Environment:    query.Get("environment"),
+	}
+	if bot, err := strconv.ParseBool(query.Get("bot")); err == nil {
+		filter.Bot = &bot
+	}
+	// Tags are given as tag=key:value, once per tag
+	for _, tag := range query["tag"] {
+		if key, value, ok := strings.Cut(tag, ":"); ok && key != "" {
+			if filter.Tags == nil {
+				filter.Tags = make(map[string]string)
+			}
+			filter.Tags[key] = value
+		}
+	}
+	return filter
+}
+
+// matchesEvents reports whether the filter narrows down the events of an
+// issue rather than only picking the issue's property.
+func (f EventFilter) matchesEvents() bool {
+	return f.Type != "" || f.Browser != "" || f.BrowserVersion != "" || f.OS != "" || f.OSVersion != "" || f.DeviceType != "" || f.Bot != nil ||
+		f.Release != "" || f.Environment != "" || len(f.Tags) > 0
+}
+
+// Apply adds the filter's conditions to a query on events.
+func (f EventFilter) Apply(query *gorm.DB) *gorm.DB {
+	if f.WebPropertyID != 0 {
+		query = query.Where("web_property_id = ?", f.WebPropertyID)
+	}
+	if f.IssueID != 0 {
+		query = query.Where("issue_id = ?", f.IssueID)
+	}
+	if f.Type != "" {
+		query = query.Where("type = ?", f.Type)
+	}
+	if f.Browser != "" {
+		query = query.Where("browser_name = ?", f.Browser)
+	}
+	if f.BrowserVersion != "" {
+		query = query.Where("browser_version = ?", f.BrowserVersion)
+	}
+	if f.OS != "" {
+		query = query.Where("os_name = ?", f.OS)
+	}
+	if f.OSVersion != "" {
+		query = query.Where("os_version = ?", f.OSVersion)
+	}
+	if f.DeviceType != "" {
+		query = query.Where("device_type = ?", f.DeviceType)
+	}
+	if f.Bot != nil {
+		query = query.Where("bot = ?", *f.Bot)
+	}
+	if f.Release != "" {
+		query = query.Where("release = ?", f.Release)
+	}
+	if f.Environment != "" {
+		query = query.Where("environment = ?", f.Environment)
+	}
+	for key, value := range f.Tags {
+		query = query.Where("id IN (SELECT event_id FROM event_tags WHERE key = ? AND value = ?)", key, value)
+	}
+	return query
+}
+
+// The columns events can be broken down by
+var breakdownColumns = map[string]string{
+	"type":           "type",
+	"browser":        "browser_name",
+	"browserVersion": "TRIM(browser_name || ' ' || browser_version)",
+	"os":             "os_name",
+	"osVersion":      "TRIM(os_name || ' ' || os_version)",
+	"device":         "device_type",
+	"release":        "release",
+	"environment":    "environment",
+}
+
+// BreakdownRow is the number of events sharing a value.
+type BreakdownRow struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+type EventController struct {
+	DB *gorm.DB
+}
+
+func newEventDB(db *gorm.DB) EventController {
+	return EventController{DB: db}
+}
+
+func (ec *EventController) GetEvent(id uint) (ErrorDetailsModel, error) {
+	var event ErrorDetailsModel
+	ec.DB.First(&event, id)
+
+	if event.ID == 0 {
+		return event, errors.New("event not found")
+	}
+
+	return event, nil
+}
+
+// FilterEvents returns the events matching a filter, newest first.
+func (ec *EventController) FilterEvents(filter EventFilter) []ErrorDetailsModel {
+	events := make([]ErrorDetailsModel, 0)
+	filter.Apply(ec.DB.Order("id desc")).Find(&events)
+	return events
+}
+
+// Breakdown counts the events matching a filter by the value of a column,
+// most common first. "tags" counts every tag as "key: value" and
+// "tag:<key>" counts the values of one tag. It returns nil for an unknown
+// column.
+func (ec *EventController) Breakdown(filter EventFilter, by string) []BreakdownRow {
+	rows := make([]BreakdownRow, 0)
+	if by == "tags" || strings.HasPrefix(by, "tag:") {
+		events := filter.Apply(ec.DB.Model(&ErrorDetailsModel{}).Select("id"))
+		query := ec.DB.Model(&EventTag{}).Where("event_id IN (?)", events)
+		if key, ok := strings.CutPrefix(by, "tag:"); ok {
+			query = query.Select("value, COUNT(*) AS count").Where("key = ?", key)
+		} else {
+			query = query.Select("key || ': ' || value AS value, COUNT(*) AS count")
+		}
+		query.Group("value").Order("count desc, value").Scan(&rows)
+		return rows
+	}
+
+	column, ok := breakdownColumns[by]
+	if !ok {
+		return nil
+	}
+	filter.Apply(ec.DB.Model(&ErrorDetailsModel{})).
+		Select(column + " AS value, COUNT(*) AS count").
+		Group("value").
+		Order("count desc, value").
+		Scan(&rows)
+	return rows
+}
+
+func (ec *EventController) ListFrames(eventID int) []StackFrame {
+	frames := make([]StackFrame, 0)
+	ec.DB.Where("event_id = ?", eventID).Order("position").Find(&frames)
+	return frames
+}
+
+func (router *Router) eventFromPath(w http.ResponseWriter, r *http.Request) (ErrorDetailsModel, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid event ID", http.StatusBadRequest)
+		return ErrorDetailsModel{}, false
+	}
+	event, err := router.EventDB.GetEvent(uint(id))
+	if err != nil {
+		http.Error(w, "Event not found", http.StatusNotFound)
+		return ErrorDetailsModel{}, false
+	}
+	return event, true
+}
+
+func (router *Router) api_get_event(w http.ResponseWriter, r *http.Request) {
+	event, ok := router.eventFromPath(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"event":       event,
+		"frames":      router.EventDB.ListFrames(event.ID),
+		"breadcrumbs": router.EventDB.ListBreadcrumbs(event.ID),
+		"tags":        router.EventDB.ListTags(event.ID),
+	})
+}
+
+func (router *Router) api_list_events(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, router.EventDB.FilterEvents(eventFilterFromQuery(r.URL.Query())))
+}
+
+func (router *Router) api_event_breakdown(w http.ResponseWriter, r *http.Request) {
+	rows := router.EventDB.Breakdown(eventFilterFromQuery(r.URL.Query()), r.URL.Query().Get("by"))
+	if rows == nil {
+		http.Error(w, "Unknown breakdown", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, rows)
+}
+
+func (router *Router) handle_event(w http.ResponseWriter, r *http.Request) {
+	event, ok := router.eventFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	extra := ""
+	if len(event.Extra) > 0 {
+		encoded, _ := json.MarshalIndent(event.Extra, "", "  ")
+		extra = string(encoded)
+	}
+
+	renderTemplate(w, "event", map[string]any{
+		"Event":       event,
+		"Frames":      router.EventDB.ListFrames(event.ID),
+		"Breadcrumbs": router.EventDB.ListBreadcrumbs(event.ID),
+		"Tags":        router.EventDB.ListTags(event.ID),
+		"Extra":       extra,
+	})
+}
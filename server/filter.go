@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Dropped events are counted in IngestionStat under "filtered:<filter>"
+const outcomeFilteredPrefix = "filtered:"
+
+// The names of the inbound filters
+const (
+	FilterScriptError      = "script-error"
+	FilterBrowserExtension = "browser-extension"
+	FilterErrorPattern     = "error-pattern"
+	FilterURLPattern       = "url-pattern"
+	FilterUserAgent        = "user-agent"
+)
+
+// User agent categories that can be filtered
+const (
+	UserAgentCrawler  = "crawler"
+	UserAgentHeadless = "headless"
+)
+
+var (
+	// "Script error." is all browsers report for errors in cross-origin
+	// scripts loaded without CORS
+	scriptErrorRegex = regexp.MustCompile(`(?i)^(uncaught )?script error\.?$`)
+
+	headlessRegex = regexp.MustCompile(`(?i)headlesschrome|phantomjs|puppeteer|playwright|selenium|webdriver`)
+)
+
+// The URL schemes of scripts injected by browser extensions
+var extensionSchemes = []string{
+	"chrome-extension://",
+	"moz-extension://",
+	"safari-extension://",
+	"safari-web-extension://",
+	"ms-browser-extension://",
+}
+
+// InboundFilters drop known noise before it is stored. Patterns are
+// regular expressions; URL patterns are matched against the page URL, the
+// filename and the filename of every frame.
+type InboundFilters struct {
+	ScriptErrors        bool     `json:"scriptErrors"`
+	BrowserExtensions   bool     `json:"browserExtensions"`
+	UserAgentCategories []string `json:"userAgentCategories"`
+	ErrorPatterns       []string `json:"errorPatterns"`
+	URLPatterns         []string `json:"urlPatterns"`
+}
+
+// defaultInboundFilters are the filters new properties start with.
+func defaultInboundFilters() InboundFilters {
+	return InboundFilters{
+		ScriptErrors:        true,
+		BrowserExtensions:   true,
+		UserAgentCategories: []string{UserAgentCrawler},
+	}
+}
+
+// userAgentCategory returns whether an event came from a crawler or a
+// headless browser, or "" for anything else.
+func userAgentCategory(event *IngestedEvent) string {
+	switch {
+	case event.Bot:
+		return UserAgentCrawler
+	case headlessRegex.MatchString(event.UserAgent):
+		return UserAgentHeadless
+	}
+	return ""
+}
+
+func isExtensionURL(s string) bool {
+	s = strings.ToLower(s)
+	for _, scheme := range extensionSchemes {
+		if strings.HasPrefix(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventURLs lists the URLs an event's URL filters apply to.
+func eventURLs(event *IngestedEvent) []string {
+	urls := []string{event.URL, event.Filename}
+	for _, frame := range event.Frames {
+		urls = append(urls, frame.Filename)
+		if frame.Symbolicated {
+			urls = append(urls, frame.Minified.Filename)
+		}
+	}
+	return urls
+}
+
+func matchesAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		re, err := compilePattern(pattern)
+		if err != nil {
+			continue
+		}
+		for _, value := range values {
+			if value != "" && re.MatchString(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Match returns the name of the first filter that drops the event, or ""
+// if the event should be kept.
+func (f *InboundFilters) Match(event *IngestedEvent) string {
+	if f.ScriptErrors && scriptErrorRegex.MatchString(strings.TrimSpace(event.ErrorText)) {
+		return FilterScriptError
+	}
+
+	urls := eventURLs(event)
+	if f.BrowserExtensions {
+		for _, u := range urls {
+			if isExtensionURL(u) {
+				return FilterBrowserExtension
+			}
+		}
+	}
+
+	if category := userAgentCategory(event); category != "" {
+		for _, blocked := range f.UserAgentCategories {
+			if strings.EqualFold(blocked, category) {
+				return FilterUserAgent + ":" + category
+			}
+		}
+	}
+
+	if matchesAny(f.ErrorPatterns, event.ErrorText) {
+		return FilterErrorPattern
+	}
+	if matchesAny(f.URLPatterns, urls...) {
+		return FilterURLPattern
+	}
+	return ""
+}
+
+// validateFilters checks inbound filters before they are saved.
+func validateFilters(f *InboundFilters) error {
+	if f == nil {
+		return nil
+	}
+	for _, category := range f.UserAgentCategories {
+		if category != UserAgentCrawler && category != UserAgentHeadless {
+			return fmt.Errorf("unknown user agent category %q", category)
+		}
+	}
+	for i, pattern := range f.ErrorPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("errorPatterns[%d] is invalid: %v", i, err)
+		}
+	}
+	for i, pattern := range f.URLPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("urlPatterns[%d] is invalid: %v", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"tjseabury/overlord/stacktrace"
+	"tjseabury/overlord/types"
+	"tjseabury/overlord/useragent"
+)
+
+// The largest number of events accepted in a single batch request
+const maxBatchItems = 1000
+
+// IngestedEvent is an accepted event together with the rows that are
+// stored alongside it.
+type IngestedEvent struct {
+	ErrorDetailsModel
+	Frames      []StackFrame
+	Breadcrumbs []EventBreadcrumb
+	Tags        []EventTag
+}
+
+// newIngestedEvent stamps a payload with its property and parses its user
+// agent and stack trace.
+func newIngestedEvent(property *WebProperty, data types.ErrorDetails) IngestedEvent {
+	event := IngestedEvent{
+		ErrorDetailsModel: ErrorDetailsModel{
+			ErrorDetails:  data,
+			WebPropertyID: int(property.ID),
+			SampleRate:    1,
+		},
+		Frames:      framesFor(stacktrace.Parse(data.StackTrace)),
+		Breadcrumbs: breadcrumbsFor(data.Breadcrumbs),
+		Tags:        tagsFor(property.ID, data.Tags),
+	}
+	applyUserAgent(&event.ErrorDetailsModel)
+	return event
+}
+
+// applyUserAgent fills in the browser, OS and device columns of an event
+// from its user agent.
+func applyUserAgent(event *ErrorDetailsModel) {
+	agent := useragent.Parse(event.UserAgent)
+	event.BrowserName = agent.Browser
+	event.BrowserVersion = agent.BrowserVersion
+	event.OSName = agent.OS
+	event.OSVersion = agent.OSVersion
+	event.DeviceType = agent.Device
+	event.Bot = agent.Bot
+}
+
+// prepareEvent validates and sanitizes a payload and builds the event that
+// will be stored for it.
+func (router *Router) prepareEvent(property *WebProperty, data types.ErrorDetails) (IngestedEvent, types.ValidationErrors) {
+	// Mask personal data first, so that truncation cannot cut a secret
+	// short of its pattern and the limits apply to what is stored
+	scrubbed := property.Scrubbing.Scrub(&data)
+
+	truncated := router.Limits.Fields.Apply(&data)
+
+	errs := data.Validate()
+	errs = append(errs, router.Limits.Tags.Validate(&data)...)
+	if len(errs) > 0 {
+		return IngestedEvent{}, errs
+	}
+
+	if !property.AllowsDomain(data.Domain) {
+		return IngestedEvent{}, types.ValidationErrors{{
+			Field:   "domain",
+			Code:    "domain.forbidden",
+			Message: "Domain is not allowed for this token",
+		}}
+	}
+
+	event := newIngestedEvent(property, data)
+	event.Truncated = truncated
+	event.ScrubbedRules = scrubbed
+	router.Symbolicator.Symbolicate(property.ID, data.Release, event.Frames)
+
+	return event, nil
+}
+
+// screenEvent runs an event through the property's inbound filters and
+// sampling. It returns the outcome the event is dropped with, or "" when it
+// should be stored.
+func screenEvent(property *WebProperty, event *IngestedEvent) string {
+	if filter := property.Filters.Match(event); filter != "" {
+		return outcomeFilteredPrefix + filter
+	}
+	if !sampleEvent(property, event) {
+		return OutcomeSampled
+	}
+	return ""
+}
+
+// rejectEvent responds to a payload that prepareEvent rejected, counting it
+// as invalid.
+func (router *Router) rejectEvent(w http.ResponseWriter, property *WebProperty, errs types.ValidationErrors) {
+	recordOutcome(router.DB, property.ID, OutcomeInvalid, 1)
+	status := http.StatusUnprocessableEntity
+	if errs[0].Code == "domain.forbidden" {
+		status = http.StatusForbidden
+	}
+	writeJSON(w, status, map[string]any{
+		"message": "Validation failed",
+		"errors":  errs,
+	})
+}
+
+// acceptEvent screens a prepared event, checks it against the property's
+// quota and queues it to be stored. Events dropped by screening count as
+// accepted so clients do not retry them, and do not use up the quota. When
+// the event cannot be accepted it writes the error response itself and
+// returns false.
+func (router *Router) acceptEvent(w http.ResponseWriter, property *WebProperty, event IngestedEvent) bool {
+	if outcome := screenEvent(property, &event); outcome != "" {
+		recordOutcome(router.DB, property.ID, outcome, 1)
+		return true
+	}
+
+	if router.Quotas.Reserve(property, 1) == 0 {
+		recordOutcome(router.DB, property.ID, OutcomeQuotaExceeded, 1)
+		writeTooManyRequests(w, untilTomorrow(), "Daily quota exceeded")
+		return false
+	}
+
+	// Queue the event to be grouped and written to the database
+	if !router.Queue.Enqueue([]IngestedEvent{event}) {
+		router.Quotas.Release(property.ID, 1)
+		recordOutcome(router.DB, property.ID, OutcomeQueueFull, 1)
+		writeServiceUnavailable(w)
+		return false
+	}
+	return true
+}
+
+// acceptEvents prepares, screens and queues the payloads of a batch, filling
+// in the result of each item. Nil payloads could not be decoded and already
+// have their errors set. When the batch cannot be queued at all it writes
+// the error response itself and returns false.
+func (router *Router) acceptEvents(w http.ResponseWriter, property *WebProperty, payloads []*types.ErrorDetails, result *types.BatchResult) bool {
+	// Validate every item independently, collecting the ones to store
+	events := make([]IngestedEvent, 0, len(payloads))
+	eventIndexes := make([]int, 0, len(payloads))
+	invalid := 0
+	dropped := make(map[string]int)
+	for i, data := range payloads {
+		result.Results[i].Index = i
+		if data == nil {
+			continue
+		}
+
+		event, errs := router.prepareEvent(property, *data)
+		if len(errs) > 0 {
+			result.Results[i].Errors = errs
+			invalid++
+			continue
+		}
+		// Dropped events count as accepted so clients do not retry them
+		if outcome := screenEvent(property, &event); outcome != "" {
+			result.Results[i].Accepted = true
+			dropped[outcome]++
+			continue
+		}
+		events = append(events, event)
+		eventIndexes = append(eventIndexes, i)
+	}
+
+	recordOutcome(router.DB, property.ID, OutcomeInvalid, invalid)
+	for outcome, n := range dropped {
+		recordOutcome(router.DB, property.ID, outcome, n)
+	}
+
+	// Reject whatever does not fit in the property's daily quota
+	if reserved := router.Quotas.Reserve(property, len(events)); reserved < len(events) {
+		if reserved == 0 {
+			recordOutcome(router.DB, property.ID, OutcomeQuotaExceeded, len(events))
+			writeTooManyRequests(w, untilTomorrow(), "Daily quota exceeded")
+			return false
+		}
+		for _, i := range eventIndexes[reserved:] {
+			result.Results[i].Errors = types.ValidationErrors{{
+				Code:    "quota.exceeded",
+				Message: "Daily quota exceeded",
+			}}
+		}
+		recordOutcome(router.DB, property.ID, OutcomeQuotaExceeded, len(events)-reserved)
+		events = events[:reserved]
+		eventIndexes = eventIndexes[:reserved]
+	}
+
+	// Hand the accepted events to the writer workers
+	if len(events) > 0 && !router.Queue.Enqueue(events) {
+		router.Quotas.Release(property.ID, len(events))
+		recordOutcome(router.DB, property.ID, OutcomeQueueFull, len(events))
+		writeServiceUnavailable(w)
+		return false
+	}
+
+	for _, i := range eventIndexes {
+		result.Results[i].Accepted = true
+	}
+	for _, item := range result.Results {
+		if item.Accepted {
+			result.Accepted++
+		}
+	}
+	result.Rejected = len(payloads) - result.Accepted
+
+	return true
+}
+
+// decodeBatch splits a batch body into its raw items. The body is either a
+// JSON array of payloads or newline-delimited JSON with one payload per line.
+func decodeBatch(body []byte) ([]json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, err
+		}
+		return items, nil
+	}
+
+	items := make([]json.RawMessage, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(trimmed)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		items = append(items, json.RawMessage(bytes.Clone(line)))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (router *Router) api_report_error_batch(w http.ResponseWriter, r *http.Request) {
+	property, ok := router.admitIngestion(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := readBody(w, r, router.Limits.MaxBatchBodyBytes)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	items, err := decodeBatch(body)
+	if err != nil {
+		http.Error(w, "Error parsing batch body", http.StatusBadRequest)
+		return
+	}
+	if len(items) == 0 {
+		http.Error(w, "Batch is empty", http.StatusBadRequest)
+		return
+	}
+	if len(items) > maxBatchItems {
+		http.Error(w, "Batch is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	result := types.BatchResult{Results: make([]types.BatchItemResult, len(items))}
+	payloads := make([]*types.ErrorDetails, len(items))
+	undecodable := 0
+	for i, item := range items {
+		var data types.ErrorDetails
+		if err := json.Unmarshal(item, &data); err != nil {
+			result.Results[i].Errors = types.ValidationErrors{{
+				Code:    "json.invalid",
+				Message: "Item is not a valid JSON object",
+			}}
+			undecodable++
+			continue
+		}
+		payloads[i] = &data
+	}
+	recordOutcome(router.DB, property.ID, OutcomeInvalid, undecodable)
+
+	if !router.acceptEvents(w, &property, payloads, &result) {
+		return
+	}
+
+	log.Printf("Batch accepted %d of %d events", result.Accepted, len(items))
+
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"tjseabury/overlord/types"
+
+	"gorm.io/gorm"
+)
+
+// Issue groups every event of a web property that shares a fingerprint, so
+// one bug firing thousands of times shows up once.
+type Issue struct {
+	ID            uint      `gorm:"primarykey" json:"id"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+	WebPropertyID uint      `gorm:"not null;uniqueIndex:idx_issue_fingerprint" json:"webPropertyId"`
+	Fingerprint   string    `gorm:"size:64;not null;uniqueIndex:idx_issue_fingerprint" json:"fingerprint"`
+	Type          string    `gorm:"size:32;not null;default:error;index" json:"type"`
+	Title         string    `gorm:"not null" json:"title"`
+	Culprit       string    `gorm:"not null" json:"culprit"`
+	Occurrences   int       `gorm:"not null;default:0" json:"occurrences"`
+	// Occurrences extrapolated from the sample rates of the stored events
+	EstimatedOccurrences float64   `gorm:"not null;default:0" json:"estimatedOccurrences"`
+	FirstSeen            time.Time `gorm:"not null" json:"firstSeen"`
+	LastSeen             time.Time `gorm:"not null;index" json:"lastSeen"`
+}
+
+// The number of stack frames that contribute to a fingerprint
+const fingerprintFrames = 3
+
+var (
+	uncaughtPrefix  = regexp.MustCompile(`^(?i)uncaught\s+`)
+	uuidPattern     = regexp.MustCompile(`(?i)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+	hexPattern      = regexp.MustCompile(`(?i)\b0x[0-9a-f]+\b`)
+	numberPattern   = regexp.MustCompile(`\d+`)
+	whitespaceRegex = regexp.MustCompile(`\s+`)
+)
+
+// normalizeErrorText strips the parts of an error message that vary between
+// occurrences of the same bug, such as IDs and numbers.
+func normalizeErrorText(text string) string {
+	text = strings.TrimSpace(text)
+	text = uncaughtPrefix.ReplaceAllString(text, "")
+	text = uuidPattern.ReplaceAllString(text, "<uuid>")
+	text = hexPattern.ReplaceAllString(text, "<hex>")
+	text = numberPattern.ReplaceAllString(text, "<n>")
+	text = whitespaceRegex.ReplaceAllString(text, " ")
+	return strings.ToLower(text)
+}
+
+// normalizeFilename drops query strings and fragments, which are often
+// cache busters.
+func normalizeFilename(filename string) string {
+	if i := strings.IndexAny(filename, "?#"); i >= 0 {
+		filename = filename[:i]
+	}
+	return strings.TrimSpace(filename)
+}
+
+// fingerprintFramesOf picks the frames that identify where an error came
+// from: the top in-app frames, or the top frames if none are in-app.
+func fingerprintFramesOf(frames []StackFrame) []StackFrame {
+	inApp := make([]StackFrame, 0, fingerprintFrames)
+	for _, frame := range frames {
+		if frame.InApp && len(inApp) < fingerprintFrames {
+			inApp = append(inApp, frame)
+		}
+	}
+	if len(inApp) > 0 {
+		return inApp
+	}
+	if len(frames) > fingerprintFrames {
+		return frames[:fingerprintFrames]
+	}
+	return frames
+}
+
+// Fingerprint computes the grouping key of an event from its normalized
+// error text, filename and top stack frames. Line and column numbers are
+// left out so that unrelated edits to a file do not split an issue.
+func Fingerprint(e *types.ErrorDetails, frames []StackFrame) string {
+	h := sha256.New()
+	// Errors are left out so fingerprints from before event types still match
+	if e.Type != "" && e.Type != types.EventTypeError {
+		h.Write([]byte(e.Type))
+		h.Write([]byte{0})
+	}
+	// Violations are grouped by directive and blocked origin alone, wherever
+	// on the site they happen
+	if e.Type == types.EventTypeCSPViolation {
+		h.Write([]byte(strings.ToLower(strings.TrimSpace(e.ErrorText))))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	h.Write([]byte(normalizeErrorText(e.ErrorText)))
+	h.Write([]byte{0})
+	h.Write([]byte(normalizeFilename(e.Filename)))
+	for _, frame := range fingerprintFramesOf(frames) {
+		h.Write([]byte{0})
+		h.Write([]byte(frame.Function + "@" + normalizeFilename(frame.Filename)))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordIssue finds or creates the issue an event belongs to, bumps its
+// occurrence count and links the event to it.
+func recordIssue(tx *gorm.DB, event *IngestedEvent) error {
+	now := time.Now()
+	fp := Fingerprint(&event.ErrorDetails, event.Frames)
+
+	var issue Issue
+	err := tx.Where("web_property_id = ? AND fingerprint = ?", event.WebPropertyID, fp).First(&issue).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		issue = Issue{
+			WebPropertyID:        uint(event.WebPropertyID),
+			Fingerprint:          fp,
+			Type:                 event.Type,
+			Title:                strings.TrimSpace(event.ErrorText),
+			Culprit:              normalizeFilename(event.Filename),
+			Occurrences:          1,
+			EstimatedOccurrences: 1 / event.SampleRate,
+			FirstSeen:            now,
+			LastSeen:             now,
+		}
+		if err := tx.Create(&issue).Error; err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		err := tx.Model(&issue).Updates(map[string]any{
+			"occurrences":           gorm.Expr("occurrences + ?", 1),
+			"estimated_occurrences": gorm.Expr("estimated_occurrences + ?", 1/event.SampleRate),
+			"last_seen":             now,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	event.IssueID = int(issue.ID)
+	return nil
+}
+
+// storeEvents groups events into issues and inserts them with their
+// frames, breadcrumbs and tags in a single transaction, counting them
+// against their properties' daily quotas.
+func storeEvents(db *gorm.DB, events []IngestedEvent) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := insertEvents(tx, events); err != nil {
+			return err
+		}
+
+		accepted := make(map[uint]int)
+		for i := range events {
+			accepted[uint(events[i].WebPropertyID)]++
+		}
+		for propertyID, n := range accepted {
+			if err := recordOutcome(tx, propertyID, OutcomeAccepted, n); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// insertEvents groups events into issues and inserts them with their
+// frames, breadcrumbs and tags, without counting them as ingested.
+func insertEvents(tx *gorm.DB, events []IngestedEvent) error {
+	models := make([]ErrorDetailsModel, len(events))
+	for i := range events {
+		if err := recordIssue(tx, &events[i]); err != nil {
+			return err
+		}
+		models[i] = events[i].ErrorDetailsModel
+	}
+	if err := tx.Create(&models).Error; err != nil {
+		return err
+	}
+
+	if err := recordReleases(tx, events); err != nil {
+		return err
+	}
+
+	frames := make([]StackFrame, 0)
+	breadcrumbs := make([]EventBreadcrumb, 0)
+	tags := make([]EventTag, 0)
+	for i := range events {
+		events[i].ErrorDetailsModel = models[i]
+		for j := range events[i].Frames {
+			events[i].Frames[j].EventID = models[i].ID
+		}
+		for j := range events[i].Breadcrumbs {
+			events[i].Breadcrumbs[j].EventID = models[i].ID
+		}
+		for j := range events[i].Tags {
+			events[i].Tags[j].EventID = models[i].ID
+		}
+		frames = append(frames, events[i].Frames...)
+		breadcrumbs = append(breadcrumbs, events[i].Breadcrumbs...)
+		tags = append(tags, events[i].Tags...)
+	}
+	if len(frames) > 0 {
+		if err := tx.CreateInBatches(&frames, 500).Error; err != nil {
+			return err
+		}
+	}
+	if len(breadcrumbs) > 0 {
+		if err := tx.CreateInBatches(&breadcrumbs, 500).Error; err != nil {
+			return err
+		}
+	}
+	if len(tags) > 0 {
+		if err := tx.CreateInBatches(&tags, 500).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type IssueController struct {
+	DB *gorm.DB
+}
+
+func newIssueDB(db *gorm.DB) IssueController {
+	return IssueController{DB: db}
+}
+
+func (ic *IssueController) GetIssue(id uint) (Issue, error) {
+	var issue Issue
+	ic.DB.First(&issue, id)
+
+	if issue.ID == 0 {
+		return issue, errors.New("issue not found")
+	}
+
+	return issue, nil
+}
+
+// ListIssues returns issues with the most recently seen first. A zero
+// propertyID lists the issues of every property.
+func (ic *IssueController) ListIssues(propertyID uint) []Issue {
+	return ic.FilterIssues(EventFilter{WebPropertyID: propertyID})
+}
+
+// FilterIssues returns the issues with at least one event matching a
+// filter, with the most recently seen first.
+func (ic *IssueController) FilterIssues(filter EventFilter) []Issue {
+	issues := make([]Issue, 0)
+	query := ic.DB.Order("last_seen desc")
+	if filter.WebPropertyID != 0 {
+		query = query.Where("web_property_id = ?", filter.WebPropertyID)
+	}
+	if filter.IssueID != 0 {
+		query = query.Where("id = ?", filter.IssueID)
+	}
+	if filter.matchesEvents() {
+		events := filter.Apply(ic.DB.Model(&ErrorDetailsModel{}).Select("issue_id"))
+		query = query.Where("id IN (?)", events)
+	}
+	query.Find(&issues)
+	return issues
+}
+
+// ListEvents returns the raw events grouped into an issue, newest first.
+func (ic *IssueController) ListEvents(issueID uint) []ErrorDetailsModel {
+	events := make([]ErrorDetailsModel, 0)
+	ic.DB.Where("issue_id = ?", issueID).Order("id desc").Find(&events)
+	return events
+}
+
+func (router *Router) issueFromPath(w http.ResponseWriter, r *http.Request) (Issue, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid issue ID", http.StatusBadRequest)
+		return Issue{}, false
+	}
+	issue, err := router.IssueDB.GetIssue(uint(id))
+	if err != nil {
+		http.Error(w, "Issue not found", http.StatusNotFound)
+		return Issue{}, false
+	}
+	return issue, true
+}
+
+func (router *Router) api_list_issues(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, router.IssueDB.FilterIssues(eventFilterFromQuery(r.URL.Query())))
+}
+
+func (router *Router) api_get_issue(w http.ResponseWriter, r *http.Request) {
+	issue, ok := router.issueFromPath(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, issue)
+}
+
+func (router *Router) api_list_issue_events(w http.ResponseWriter, r *http.Request) {
+	issue, ok := router.issueFromPath(w, r)
+	if !ok {
+		return
+	}
+	filter := eventFilterFromQuery(r.URL.Query())
+	filter.IssueID = issue.ID
+	writeJSON(w, http.StatusOK, router.EventDB.FilterEvents(filter))
+}
+
+func (router *Router) handle_issue(w http.ResponseWriter, r *http.Request) {
+	issue, ok := router.issueFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	filter := EventFilter{IssueID: issue.ID}
+	renderTemplate(w, "issue", map[string]any{
+		"Issue":    issue,
+		"Events":   router.IssueDB.ListEvents(issue.ID),
+		"Browsers": router.EventDB.Breakdown(filter, "browserVersion"),
+		"Systems":  router.EventDB.Breakdown(filter, "osVersion"),
+		"Devices":  router.EventDB.Breakdown(filter, "device"),
+		"Tags":     router.EventDB.Breakdown(filter, "tags"),
+	})
+}
@@ -11,7 +11,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"syscall"
 	"time"
 
 	"tjseabury/overlord/types"
@@ -51,12 +54,15 @@ func main() {
 		os.Mkdir("data", 0755)
 	}
 
-	db, err := gorm.Open(sqlite.Open("data/app.db"), &gorm.Config{})
+	// Wait on locks rather than failing while the ingestion workers write
+	db, err := gorm.Open(sqlite.Open("data/app.db?_busy_timeout=5000&_journal_mode=WAL"), &gorm.Config{})
 	if err != nil {
 		panic("failed to connect database")
 	}
-	db.AutoMigrate(&User{})
-	db.AutoMigrate(&types.ErrorDetails{})
+	migrate(db)
+
+	// Initialize the session store
+	Init()
 
 	user_db := newUserDB(db)
 
@@ -79,6 +85,16 @@ func main() {
 
 	// Start the mock error generator
 	if APP_CONFIG["MOCK_MODE"] == "TRUE" {
+		// Mock errors and the /test page report against a dedicated property
+		property_db := newWebPropertyDB(db)
+		mockProperty, err := property_db.FindByToken("test-token")
+		if err != nil {
+			mockProperty = WebProperty{Name: "Mock", Token: "test-token"}
+			if _, err := property_db.CreateWebProperty(&mockProperty); err != nil {
+				panic("failed to create mock web property")
+			}
+		}
+
 		ctx := context.Background()
 		go func(ctx context.Context) {
 			for {
@@ -88,8 +104,8 @@ func main() {
 					return
 				default:
 					// If the context is not done, continue with the loop
-					mockError := random_mock_error()
-					db.Create(mockError)
+					mockError := newIngestedEvent(&mockProperty, random_mock_error())
+					storeEvents(db, []IngestedEvent{mockError})
 					fmt.Println("Inserting mock error.")
 					time.Sleep(time.Second * time.Duration(rand.Intn(30)))
 				}
@@ -134,12 +150,162 @@ func main() {
 </html>`))
 	})
 
-	log.Fatal(http.ListenAndServe(":8080", router))
+	server := &http.Server{Addr: ":8080", Handler: router}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// On shutdown, stop taking requests and write out the ingestion queue
+	stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	<-stop.Done()
+
+	log.Println("Shutting down")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
+	server.Shutdown(shutdownCtx)
+	router.Queue.Close()
+}
+
+// migrate creates or updates the tables of every model
+func migrate(db *gorm.DB) {
+	db.AutoMigrate(&User{})
+	db.AutoMigrate(&WebProperty{})
+	db.AutoMigrate(&Issue{})
+	db.AutoMigrate(&ErrorDetailsModel{})
+	db.AutoMigrate(&StackFrame{})
+	db.AutoMigrate(&EventBreadcrumb{})
+	db.AutoMigrate(&EventTag{})
+	db.AutoMigrate(&Artifact{})
+	db.AutoMigrate(&IngestionStat{})
+	db.AutoMigrate(&Release{})
+	db.AutoMigrate(&Environment{})
+	db.AutoMigrate(&NetworkReport{})
+
+	db.AutoMigrate(&Migration{})
+
+	// Events used to be stored in error_details, before they belonged to a
+	// web property. They are moved into a property of their own and grouped
+	// into issues like any other event.
+	migrateOnce(db, "legacy-error-details", func(tx *gorm.DB) error {
+		if !tx.Migrator().HasTable("error_details") {
+			return nil
+		}
+		var count int64
+		if err := tx.Table("error_details").Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			properties := newWebPropertyDB(tx)
+			property := WebProperty{Name: "Legacy"}
+			if _, err := properties.CreateWebProperty(&property); err != nil {
+				return err
+			}
+			var rows []legacyErrorDetails
+			err := tx.Table("error_details").FindInBatches(&rows, 500, func(_ *gorm.DB, _ int) error {
+				events := make([]IngestedEvent, len(rows))
+				for i, row := range rows {
+					events[i] = newIngestedEvent(&property, row.errorDetails())
+				}
+				return insertEvents(tx, events)
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Migrator().DropTable("error_details")
+	})
+
+	// Issues from before sampling were never extrapolated
+	migrateOnce(db, "estimated-occurrences", func(tx *gorm.DB) error {
+		return tx.Model(&Issue{}).Where("estimated_occurrences = 0").Update("estimated_occurrences", gorm.Expr("occurrences")).Error
+	})
+
+	// Events from before user agent parsing have no device type
+	migrateOnce(db, "device-types", func(tx *gorm.DB) error {
+		var events []ErrorDetailsModel
+		return tx.Where("device_type = '' OR device_type IS NULL").FindInBatches(&events, 500, func(batch *gorm.DB, _ int) error {
+			for i := range events {
+				applyUserAgent(&events[i])
+			}
+			return batch.Save(&events).Error
+		}).Error
+	})
+}
+
+// Migration records a one-off data migration that has been applied
+type Migration struct {
+	Name      string `gorm:"primarykey;size:64"`
+	CreatedAt time.Time
+}
+
+// migrateOnce applies a data migration in a transaction, unless an earlier
+// startup already has.
+func migrateOnce(db *gorm.DB, name string, apply func(tx *gorm.DB) error) {
+	var count int64
+	db.Model(&Migration{}).Where("name = ?", name).Count(&count)
+	if count > 0 {
+		return
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := apply(tx); err != nil {
+			return err
+		}
+		return tx.Create(&Migration{Name: name}).Error
+	})
+	if err != nil {
+		log.Printf("Error applying migration %s: %v", name, err)
+	}
+}
+
+// legacyErrorDetails is a row of the error_details table
+type legacyErrorDetails struct {
+	Domain     string
+	ErrorText  string
+	URL        string
+	Filename   string
+	Line       int
+	Column     int
+	Datetime   string
+	UserAgent  string
+	StackTrace string
+}
+
+func (row *legacyErrorDetails) errorDetails() types.ErrorDetails {
+	return types.ErrorDetails{
+		Type:       types.EventTypeError,
+		Domain:     row.Domain,
+		ErrorText:  row.ErrorText,
+		URL:        row.URL,
+		Filename:   row.Filename,
+		Line:       row.Line,
+		Column:     row.Column,
+		Datetime:   row.Datetime,
+		UserAgent:  row.UserAgent,
+		StackTrace: row.StackTrace,
+	}
+}
+
+// artifactsDir is where uploaded source maps are stored
+func artifactsDir() string {
+	if dir := APP_CONFIG["ARTIFACTS_DIR"]; dir != "" {
+		return dir
+	}
+	return filepath.Join("data", "artifacts")
 }
 
 type Router struct {
 	DB              *gorm.DB
 	UserDB          *UserController
+	WebPropertyDB   *WebPropertyController
+	IssueDB         *IssueController
+	EventDB         *EventController
+	Symbolicator    *Symbolicator
+	Limits          *IngestionLimits
+	Quotas          *Quotas
+	Queue           *IngestQueue
 	Mux             *http.ServeMux
 	Context         context.Context
 	APIRouter       http.Handler
@@ -149,11 +315,21 @@ type Router struct {
 
 func NewRouter(context context.Context, db *gorm.DB) *Router {
 	userDB := newUserDB(db)
+	webPropertyDB := newWebPropertyDB(db)
+	issueDB := newIssueDB(db)
+	eventDB := newEventDB(db)
 	r := &Router{
-		DB:      db,
-		Mux:     http.NewServeMux(),
-		Context: context,
-		UserDB:  &userDB,
+		DB:            db,
+		Mux:           http.NewServeMux(),
+		Context:       context,
+		UserDB:        &userDB,
+		WebPropertyDB: &webPropertyDB,
+		IssueDB:       &issueDB,
+		EventDB:       &eventDB,
+		Symbolicator:  newSymbolicator(db, artifactsDir()),
+		Limits:        newIngestionLimits(),
+		Quotas:        newQuotas(db),
+		Queue:         newIngestQueueFromConfig(db),
 	}
 	r.routes()
 
@@ -173,62 +349,115 @@ func (router *Router) routes() {
 	router.Mux.HandleFunc("POST /api/auth/register", router.api_auth_register)
 	router.Mux.HandleFunc("GET /api/auth/verify-email", router.api_auth_verify_email)
 	router.Mux.HandleFunc("POST /api/report-error", router.api_report_error)
+	router.Mux.HandleFunc("POST /api/report-error/batch", router.api_report_error_batch)
+	router.Mux.HandleFunc("OPTIONS /api/report-error", router.api_report_error_preflight)
+	router.Mux.HandleFunc("OPTIONS /api/report-error/batch", router.api_report_error_preflight)
+	router.Mux.HandleFunc("POST /api/reports/{token}", router.api_reports)
+	router.Mux.HandleFunc("OPTIONS /api/reports/{token}", router.api_report_error_preflight)
+	router.Mux.HandleFunc("POST /api/csp-report/{token}", router.api_reports)
+	router.Mux.HandleFunc("OPTIONS /api/csp-report/{token}", router.api_report_error_preflight)
+	router.Mux.HandleFunc("POST /api/{project}/store/{$}", router.api_sentry_store)
+	router.Mux.HandleFunc("POST /api/{project}/envelope/{$}", router.api_sentry_envelope)
+	router.Mux.HandleFunc("OPTIONS /api/{project}/store/{$}", router.api_report_error_preflight)
+	router.Mux.HandleFunc("OPTIONS /api/{project}/envelope/{$}", router.api_report_error_preflight)
+	router.Mux.HandleFunc("POST /api/otlp/v1/logs", router.api_otlp_logs)
+	router.Mux.HandleFunc("POST /api/otlp/v1/traces", router.api_otlp_traces)
+	router.Mux.HandleFunc("OPTIONS /api/otlp/v1/logs", router.api_report_error_preflight)
+	router.Mux.HandleFunc("OPTIONS /api/otlp/v1/traces", router.api_report_error_preflight)
+	router.Mux.Handle("GET /api/web-properties", WithAuth(router.DB, http.HandlerFunc(router.api_list_web_properties)))
+	router.Mux.Handle("POST /api/web-properties", WithAuth(router.DB, http.HandlerFunc(router.api_create_web_property)))
+	router.Mux.Handle("GET /api/web-properties/{id}", WithAuth(router.DB, http.HandlerFunc(router.api_get_web_property)))
+	router.Mux.Handle("PUT /api/web-properties/{id}", WithAuth(router.DB, http.HandlerFunc(router.api_update_web_property)))
+	router.Mux.Handle("DELETE /api/web-properties/{id}", WithAuth(router.DB, http.HandlerFunc(router.api_delete_web_property)))
+	router.Mux.Handle("GET /api/ingest/queue", WithAuth(router.DB, http.HandlerFunc(router.api_ingest_queue_stats)))
+	router.Mux.Handle("GET /api/web-properties/{id}/releases", WithAuth(router.DB, http.HandlerFunc(router.api_list_releases)))
+	router.Mux.Handle("GET /api/web-properties/{id}/environments", WithAuth(router.DB, http.HandlerFunc(router.api_list_environments)))
+	router.Mux.Handle("GET /api/web-properties/{id}/network", WithAuth(router.DB, http.HandlerFunc(router.api_network_failures)))
+	router.Mux.Handle("GET /api/web-properties/{id}/stats", WithAuth(router.DB, http.HandlerFunc(router.api_web_property_stats)))
+	router.Mux.Handle("GET /api/issues", WithAuth(router.DB, http.HandlerFunc(router.api_list_issues)))
+	router.Mux.Handle("GET /api/issues/{id}", WithAuth(router.DB, http.HandlerFunc(router.api_get_issue)))
+	router.Mux.Handle("GET /api/issues/{id}/events", WithAuth(router.DB, http.HandlerFunc(router.api_list_issue_events)))
+	router.Mux.Handle("POST /api/web-properties/{id}/releases/{release}/artifacts", WithAuth(router.DB, http.HandlerFunc(router.api_upload_artifact)))
+	router.Mux.Handle("GET /api/web-properties/{id}/releases/{release}/artifacts", WithAuth(router.DB, http.HandlerFunc(router.api_list_artifacts)))
+	router.Mux.Handle("DELETE /api/artifacts/{id}", WithAuth(router.DB, http.HandlerFunc(router.api_delete_artifact)))
+	router.Mux.Handle("GET /api/events", WithAuth(router.DB, http.HandlerFunc(router.api_list_events)))
+	router.Mux.Handle("GET /api/events/breakdown", WithAuth(router.DB, http.HandlerFunc(router.api_event_breakdown)))
+	router.Mux.Handle("GET /api/events/{id}", WithAuth(router.DB, http.HandlerFunc(router.api_get_event)))
+	router.Mux.HandleFunc("GET /issues/{id}", router.handle_issue)
+	router.Mux.HandleFunc("GET /events/{id}", router.handle_event)
+	router.Mux.HandleFunc("GET /network", router.handle_network)
 	router.Mux.HandleFunc("GET /", router.handle_dashboard)
 }
 
 func (router *Router) handle_dashboard(w http.ResponseWriter, r *http.Request) {
-	errors := make([]types.ErrorDetails, 0)
-	router.DB.Find(&errors)
+	propertyNames := make(map[uint]string)
+	for _, property := range router.WebPropertyDB.ListWebProperties() {
+		propertyNames[property.ID] = property.Name
+	}
+
+	filter := eventFilterFromQuery(r.URL.Query())
+	violations := filter
+	violations.Type = types.EventTypeCSPViolation
+	renderTemplate(w, "dashboard", map[string]any{
+		"Issues":     router.IssueDB.FilterIssues(filter),
+		"Properties": propertyNames,
+		"Filter":     filter,
+		"Browsers":   router.EventDB.Breakdown(filter, "browser"),
+		"Systems":    router.EventDB.Breakdown(filter, "os"),
+		"Devices":    router.EventDB.Breakdown(filter, "device"),
+		"Types":      router.EventDB.Breakdown(EventFilter{WebPropertyID: filter.WebPropertyID}, "type"),
+		"Blocked":    router.EventDB.Breakdown(violations, "tag:csp.blocked"),
+		// Offer every release and environment, whichever one is picked
+		"Releases":     router.EventDB.Breakdown(EventFilter{WebPropertyID: filter.WebPropertyID}, "release"),
+		"Environments": router.EventDB.Breakdown(EventFilter{WebPropertyID: filter.WebPropertyID}, "environment"),
+	})
+}
 
-	// Read in the dashboard template file
-	dashboardTemplateFile, err := os.ReadFile("templates/dashboard.html")
+// renderTemplate executes templates/<name>.html. Templates are read on every
+// request so they can be edited without a rebuild.
+func renderTemplate(w http.ResponseWriter, name string, data any) {
+	templateFile, err := os.ReadFile("templates/" + name + ".html")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	dashboard_template := template.Must(template.New("dashboard").Parse(
-		string(dashboardTemplateFile),
+	page_template := template.Must(template.New(name).Parse(
+		string(templateFile),
 	))
 
 	w.Header().Set("Content-Type", "text/html")
-	dashboard_template.Execute(w, errors)
+	page_template.Execute(w, data)
 }
 
 func (router *Router) api_report_error(w http.ResponseWriter, r *http.Request) {
-
-	w.Header().Set("Access-Control-Allow-Origin", "*")                                // Allow any origin
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS") // Allowed methods
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")     // Allowed headers
-
-	// If it's a preflight OPTIONS request, send an OK status and return
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
+	property, ok := router.admitIngestion(w, r)
+	if !ok {
 		return
 	}
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+
+	body, err := readBody(w, r, router.Limits.MaxBodyBytes)
+	if err != nil {
+		writeBodyError(w, err)
 		return
 	}
 
 	var data types.ErrorDetails
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+	if err := json.Unmarshal(body, &data); err != nil {
 		http.Error(w, "Error parsing JSON body", http.StatusBadRequest)
 		return
 	}
 
-	// Validate the data
-	// err := data.ValidateFields()
-	// if err != nil {
-	// 	log.Println(data, err)
-	// 	http.Error(w, "Invalid data", http.StatusBadRequest)
-	// 	return
-	// }
-	// Check token in the data matches the one in the db
-
-	// Insert the error into the database
-	router.DB.Create(&data)
+	// Validate and sanitize the data, reporting every invalid field
+	event, errs := router.prepareEvent(&property, data)
+	if len(errs) > 0 {
+		log.Println(data, errs)
+		router.rejectEvent(w, &property, errs)
+		return
+	}
 
-	log.Printf("Inserted: %+v", data)
+	if !router.acceptEvent(w, &property, event) {
+		return
+	}
 
 	// Tell the client that the error was successfully logged
 	w.WriteHeader(http.StatusOK)
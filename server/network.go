@@ -0,0 +1,192 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"tjseabury/overlord/types"
+
+	"gorm.io/gorm"
+)
+
+// The Reporting API type of Network Error Logging reports. Pages opt in
+// with a NEL header naming a Reporting API endpoint group:
+//
+//	NEL: {"report_to":"overlord","max_age":86400,"success_fraction":0.01,"failure_fraction":1}
+const reportTypeNetworkError = "network-error"
+
+// The NEL type of requests that succeeded
+const networkTypeOK = "ok"
+
+// NetworkReport is a NEL report of a request to a web property. Browsers
+// report a sample of requests, both failed and successful, so counts are
+// extrapolated from each report's sampling fraction.
+type NetworkReport struct {
+	ID            uint      `gorm:"primarykey" json:"id"`
+	CreatedAt     time.Time `gorm:"index" json:"createdAt"`
+	WebPropertyID uint      `gorm:"not null;index" json:"webPropertyId"`
+	// The URL of the request, without its query string or fragment
+	URL       string `gorm:"not null;index" json:"url"`
+	Method    string `gorm:"size:16;not null" json:"method"`
+	UserAgent string `gorm:"not null" json:"userAgent"`
+	// Where the request failed: dns, connection or application
+	Phase string `gorm:"size:16;not null;index" json:"phase"`
+	// The NEL error type, such as dns.name_not_resolved or tcp.reset, or ok
+	Type             string  `gorm:"size:64;not null;index" json:"type"`
+	Failed           bool    `gorm:"not null;index" json:"failed"`
+	ServerIP         string  `gorm:"size:64;not null" json:"serverIp"`
+	Protocol         string  `gorm:"size:16;not null" json:"protocol"`
+	StatusCode       int     `gorm:"not null" json:"statusCode"`
+	ElapsedTime      int     `gorm:"not null" json:"elapsedTime"` // milliseconds
+	SamplingFraction float64 `gorm:"not null;default:1" json:"samplingFraction"`
+}
+
+// newNetworkReport reads a network-error report, checking that it is about
+// a page of the property.
+func newNetworkReport(property *WebProperty, report *browserReport, received time.Time) (NetworkReport, types.ValidationErrors) {
+	u, err := url.Parse(strings.TrimSpace(report.URL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return NetworkReport{}, types.ValidationErrors{{Field: "url", Code: "url.invalid", Message: "URL is invalid"}}
+	}
+	if !property.AllowsDomain(u.Hostname()) {
+		return NetworkReport{}, types.ValidationErrors{{Field: "domain", Code: "domain.forbidden", Message: "Domain is not allowed for this token"}}
+	}
+
+	fraction, ok := report.Body["sampling_fraction"].(float64)
+	if !ok || fraction <= 0 || fraction > 1 {
+		fraction = 1
+	}
+	errorType := cmp.Or(strings.ToLower(report.text("type")), "unknown")
+	return NetworkReport{
+		CreatedAt:        received.Add(-time.Duration(report.Age) * time.Millisecond),
+		WebPropertyID:    property.ID,
+		URL:              u.Scheme + "://" + u.Host + u.EscapedPath(),
+		Method:           strings.ToUpper(report.text("method")),
+		UserAgent:        report.UserAgent,
+		Phase:            strings.ToLower(report.text("phase")),
+		Type:             errorType,
+		Failed:           errorType != networkTypeOK,
+		ServerIP:         report.text("server_ip"),
+		Protocol:         report.text("protocol"),
+		StatusCode:       report.number("status_code"),
+		ElapsedTime:      report.number("elapsed_time"),
+		SamplingFraction: fraction,
+	}, nil
+}
+
+// storeNetworkReports inserts network reports, counting them as accepted
+// against their properties' daily quotas.
+func storeNetworkReports(db *gorm.DB, reports []NetworkReport) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateInBatches(&reports, 100).Error; err != nil {
+			return err
+		}
+		accepted := make(map[uint]int)
+		for i := range reports {
+			accepted[reports[i].WebPropertyID]++
+		}
+		for propertyID, n := range accepted {
+			if err := recordOutcome(tx, propertyID, OutcomeAccepted, n); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// NetworkFailureRate is how many requests failed, overall or of one URL,
+// extrapolated from the sampled reports.
+type NetworkFailureRate struct {
+	Value       string  `json:"value"`
+	Reports     int     `json:"reports"`
+	Failures    float64 `json:"failures"`
+	Requests    float64 `json:"requests"`
+	FailureRate float64 `json:"failureRate"`
+}
+
+// Percent is the failure rate as a percentage.
+func (r NetworkFailureRate) Percent() float64 {
+	return r.FailureRate * 100
+}
+
+// networkFailureRates aggregates a property's NEL reports since a time by
+// error type or by URL. Each error type's rate is out of every request,
+// while each URL's rate is out of the requests to that URL. It returns nil
+// for anything else.
+func networkFailureRates(db *gorm.DB, propertyID uint, since time.Time, by string) []NetworkFailureRate {
+	column := map[string]string{"type": "type", "url": "url"}[by]
+	if column == "" {
+		return nil
+	}
+
+	reports := func() *gorm.DB {
+		return db.Model(&NetworkReport{}).Where("web_property_id = ? AND created_at >= ?", propertyID, since)
+	}
+	rows := make([]NetworkFailureRate, 0)
+	query := reports().Select(column + ` AS value, COUNT(*) AS reports,
+		SUM(CASE WHEN failed THEN 1.0 / sampling_fraction ELSE 0 END) AS failures,
+		SUM(1.0 / sampling_fraction) AS requests`)
+	if by == "type" {
+		query = query.Where("failed")
+	}
+	query.Group("value").Order("failures desc, value").Scan(&rows)
+
+	if by == "type" {
+		var total float64
+		reports().Select("COALESCE(SUM(1.0 / sampling_fraction), 0)").Scan(&total)
+		for i := range rows {
+			rows[i].Requests = total
+		}
+	}
+	for i := range rows {
+		if rows[i].Requests > 0 {
+			rows[i].FailureRate = rows[i].Failures / rows[i].Requests
+		}
+	}
+	return rows
+}
+
+// networkDays reads how many days back the network views go.
+func networkDays(r *http.Request) int {
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days < 1 {
+		return 7
+	}
+	return days
+}
+
+func (router *Router) api_network_failures(w http.ResponseWriter, r *http.Request) {
+	property, ok := router.webPropertyFromPath(w, r)
+	if !ok {
+		return
+	}
+	since := time.Now().AddDate(0, 0, -networkDays(r))
+	rows := networkFailureRates(router.DB, property.ID, since, cmp.Or(r.URL.Query().Get("by"), "type"))
+	if rows == nil {
+		http.Error(w, "Unknown breakdown", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, rows)
+}
+
+func (router *Router) handle_network(w http.ResponseWriter, r *http.Request) {
+	properties := router.WebPropertyDB.ListWebProperties()
+	id, _ := strconv.ParseUint(r.URL.Query().Get("webPropertyId"), 10, 64)
+	if id == 0 && len(properties) > 0 {
+		id = uint64(properties[0].ID)
+	}
+
+	days := networkDays(r)
+	since := time.Now().AddDate(0, 0, -days)
+	renderTemplate(w, "network", map[string]any{
+		"Properties": properties,
+		"PropertyID": uint(id),
+		"Days":       days,
+		"ByType":     networkFailureRates(router.DB, uint(id), since, "type"),
+		"ByURL":      networkFailureRates(router.DB, uint(id), since, "url"),
+	})
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"tjseabury/overlord/otlp"
+	"tjseabury/overlord/stacktrace"
+	"tjseabury/overlord/types"
+)
+
+// OpenTelemetry SDKs and collectors export to Overlord's OTLP/HTTP
+// receiver, with the ingestion token as a header:
+//
+//	OTEL_EXPORTER_OTLP_ENDPOINT=https://<overlord host>/api/otlp
+//	OTEL_EXPORTER_OTLP_HEADERS=X-ACCESS-TOKEN=<token>
+//
+// Log records and span events that record an exception become error events.
+// Everything else is accepted and ignored.
+
+// Characters a service name may have that a domain may not
+var invalidDomainChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// otelException is an exception recorded by OpenTelemetry, in a log record
+// or a span event, along with what recorded it.
+type otelException struct {
+	Resource   otlp.Attributes
+	Attributes otlp.Attributes
+	// The log body, for records that give no exception.message
+	Message string
+	Time    time.Time
+	TraceID string
+	SpanID  string
+	// Tags of what recorded the exception; empty ones are left out
+	Tags map[string]string
+}
+
+// The domain of events from services that do not name themselves
+const unknownServiceDomain = "unknown-service.otel"
+
+// otelDomain turns a service name into the domain its events are recorded
+// under, so a property's allowed domains can list the services that may
+// report to it. Names that are not valid domains on their own, such as
+// "db", are recorded as "db.otel".
+func otelDomain(service string) string {
+	domain := strings.Trim(invalidDomainChars.ReplaceAllString(strings.ToLower(service), "-"), "-.")
+	if domain == "" {
+		return unknownServiceDomain
+	}
+	if validDomain(domain) {
+		return domain
+	}
+	domain = strings.Trim(domain[:min(len(domain), 58)], "-.") + ".otel"
+	if validDomain(domain) {
+		return domain
+	}
+	return unknownServiceDomain
+}
+
+func validDomain(domain string) bool {
+	return (&types.ErrorDetails{Domain: domain}).SanitizeDomain() == nil
+}
+
+// errorDetails maps the exception onto an Overlord payload. It returns
+// false if the attributes record no exception.
+func (e *otelException) errorDetails(userAgent string, received time.Time) (types.ErrorDetails, bool) {
+	exceptionType := e.Attributes.String("exception.type")
+	message := cmp.Or(e.Attributes.String("exception.message"), e.Message)
+	if exceptionType == "" && e.Attributes.String("exception.message") == "" {
+		return types.ErrorDetails{}, false
+	}
+
+	service := e.Resource.String("service.name")
+	data := types.ErrorDetails{
+		ErrorText:   strings.TrimSuffix(strings.TrimPrefix(exceptionType+": "+message, ": "), ": "),
+		StackTrace:  e.Attributes.String("exception.stacktrace"),
+		Domain:      otelDomain(service),
+		UserAgent:   cmp.Or(e.Attributes.String("user_agent.original"), userAgent, "opentelemetry"),
+		Release:     e.Resource.String("service.version"),
+		Environment: cmp.Or(e.Resource.String("deployment.environment.name"), e.Resource.String("deployment.environment")),
+		Tags:        e.Tags,
+		Extra:       make(map[string]any),
+	}
+
+	// The culprit is the top in-app frame of the stack, or where the
+	// exception was recorded according to the code attributes
+	if frames := stacktrace.Parse(data.StackTrace); len(frames) > 0 {
+		frame := frames[0]
+		for _, f := range frames {
+			if f.InApp {
+				frame = f
+				break
+			}
+		}
+		data.Filename, data.Line, data.Column = frame.Filename, frame.Line, frame.Column
+	} else {
+		data.Filename = cmp.Or(e.Attributes.String("code.file.path"), e.Attributes.String("code.filepath"))
+		data.Line, _ = strconv.Atoi(cmp.Or(e.Attributes.String("code.line.number"), e.Attributes.String("code.lineno")))
+	}
+	data.Filename = cmp.Or(data.Filename, "unknown")
+	data.Line = max(data.Line, 1)
+	data.Column = max(data.Column, 1)
+
+	if u, err := url.Parse(e.Attributes.String("url.full")); err == nil && u.Hostname() != "" {
+		data.URL = u.String()
+	} else {
+		data.URL = "https://" + data.Domain + "/"
+	}
+
+	when := e.Time
+	if when.IsZero() {
+		when = received
+	}
+	data.Datetime = when.UTC().Format(time.RFC3339)
+
+	data.Tags["service.name"] = service
+	data.Tags["trace.id"] = e.TraceID
+	data.Tags["span.id"] = e.SpanID
+	for key, value := range data.Tags {
+		if value == "" {
+			delete(data.Tags, key)
+		}
+	}
+	for _, kv := range e.Attributes {
+		if !strings.HasPrefix(kv.Key, "exception.") {
+			data.Extra[kv.Key] = kv.Value.Any()
+		}
+	}
+	return data, true
+}
+
+// logExceptions collects the exceptions recorded in log records.
+func logExceptions(request *otlp.LogsRequest) []otelException {
+	exceptions := make([]otelException, 0)
+	for _, resource := range request.ResourceLogs {
+		for _, scope := range resource.ScopeLogs {
+			for _, record := range scope.LogRecords {
+				when := record.TimeUnixNano.Time()
+				if when.IsZero() {
+					when = record.ObservedTimeUnixNano.Time()
+				}
+				exceptions = append(exceptions, otelException{
+					Resource:   resource.Resource.Attributes,
+					Attributes: record.Attributes,
+					Message:    record.Body.String(),
+					Time:       when,
+					TraceID:    record.TraceID,
+					SpanID:     record.SpanID,
+					Tags:       map[string]string{"otel.scope": scope.Scope.Name, "level": strings.ToLower(record.SeverityText)},
+				})
+			}
+		}
+	}
+	return exceptions
+}
+
+// spanExceptions collects the exceptions recorded as span events.
+func spanExceptions(request *otlp.TracesRequest) []otelException {
+	exceptions := make([]otelException, 0)
+	for _, resource := range request.ResourceSpans {
+		for _, scope := range resource.ScopeSpans {
+			for _, span := range scope.Spans {
+				for _, event := range span.Events {
+					exceptions = append(exceptions, otelException{
+						Resource:   resource.Resource.Attributes,
+						Attributes: event.Attributes,
+						Time:       event.TimeUnixNano.Time(),
+						TraceID:    span.TraceID,
+						SpanID:     span.SpanID,
+						Tags:       map[string]string{"otel.scope": scope.Scope.Name, "span.name": span.Name},
+					})
+				}
+			}
+		}
+	}
+	return exceptions
+}
+
+// readOTLP admits an OTLP/HTTP request and reads its body.
+func (router *Router) readOTLP(w http.ResponseWriter, r *http.Request) (WebProperty, []byte, bool) {
+	property, ok := router.admitIngestion(w, r)
+	if !ok {
+		return WebProperty{}, nil, false
+	}
+	body, err := readBody(w, r, router.Limits.MaxBatchBodyBytes)
+	if err != nil {
+		writeBodyError(w, err)
+		return WebProperty{}, nil, false
+	}
+	return property, body, true
+}
+
+func writeOTLPDecodeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, otlp.ErrContentType) {
+		http.Error(w, "Content-Type must be application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	http.Error(w, "Error parsing OTLP request", http.StatusBadRequest)
+}
+
+// acceptOTLP stores the exceptions of an export request and responds in
+// the request's encoding. Exceptions that are rejected are counted in a
+// partial success under rejectedField, its name in OTLP/JSON.
+func (router *Router) acceptOTLP(w http.ResponseWriter, r *http.Request, property *WebProperty, exceptions []otelException, rejectedField string) {
+	received := time.Now()
+	payloads := make([]*types.ErrorDetails, 0, len(exceptions))
+	for i := range exceptions {
+		if data, ok := exceptions[i].errorDetails(r.UserAgent(), received); ok {
+			payloads = append(payloads, &data)
+		}
+	}
+	if len(payloads) > maxBatchItems {
+		http.Error(w, "Batch is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	result := types.BatchResult{Results: make([]types.BatchItemResult, len(payloads))}
+	if !router.acceptEvents(w, property, payloads, &result) {
+		return
+	}
+
+	var rejected int64
+	message := ""
+	for _, item := range result.Results {
+		if len(item.Errors) > 0 {
+			rejected++
+			message = cmp.Or(message, item.Errors[0].Message)
+		}
+	}
+	if rejected > 0 {
+		message = fmt.Sprintf("%d exceptions were rejected: %s", rejected, message)
+	}
+
+	if strings.HasPrefix(strings.ToLower(r.Header.Get("Content-Type")), otlp.ContentTypeProtobuf) {
+		w.Header().Set("Content-Type", otlp.ContentTypeProtobuf)
+		w.WriteHeader(http.StatusOK)
+		w.Write(otlp.MarshalResponse(rejected, message))
+		return
+	}
+	response := map[string]any{}
+	if rejected > 0 {
+		response["partialSuccess"] = map[string]any{rejectedField: rejected, "errorMessage": message}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (router *Router) api_otlp_logs(w http.ResponseWriter, r *http.Request) {
+	property, body, ok := router.readOTLP(w, r)
+	if !ok {
+		return
+	}
+	request, err := otlp.DecodeLogs(body, r.Header.Get("Content-Type"))
+	if err != nil {
+		writeOTLPDecodeError(w, err)
+		return
+	}
+	router.acceptOTLP(w, r, &property, logExceptions(request), "rejectedLogRecords")
+}
+
+func (router *Router) api_otlp_traces(w http.ResponseWriter, r *http.Request) {
+	property, body, ok := router.readOTLP(w, r)
+	if !ok {
+		return
+	}
+	request, err := otlp.DecodeTraces(body, r.Header.Get("Content-Type"))
+	if err != nil {
+		writeOTLPDecodeError(w, err)
+		return
+	}
+	router.acceptOTLP(w, r, &property, spanExceptions(request), "rejectedSpans")
+}
@@ -0,0 +1,247 @@
+// Package otlp reads the logs and traces that OpenTelemetry SDKs and
+// collectors export over OTLP/HTTP, in either its protobuf or its JSON
+// encoding. Only the fields Overlord uses are decoded.
+package otlp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The content types of OTLP/HTTP requests
+const (
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeJSON     = "application/json"
+)
+
+// ErrContentType is returned for bodies in neither OTLP encoding.
+var ErrContentType = errors.New("otlp: unsupported content type")
+
+// LogsRequest is an ExportLogsServiceRequest.
+type LogsRequest struct {
+	ResourceLogs []ResourceLogs `json:"resourceLogs"`
+}
+
+type ResourceLogs struct {
+	Resource  Resource    `json:"resource"`
+	ScopeLogs []ScopeLogs `json:"scopeLogs"`
+}
+
+type ScopeLogs struct {
+	Scope      Scope       `json:"scope"`
+	LogRecords []LogRecord `json:"logRecords"`
+}
+
+type LogRecord struct {
+	TimeUnixNano         Uint64     `json:"timeUnixNano"`
+	ObservedTimeUnixNano Uint64     `json:"observedTimeUnixNano"`
+	SeverityNumber       int        `json:"severityNumber"`
+	SeverityText         string     `json:"severityText"`
+	Body                 AnyValue   `json:"body"`
+	Attributes           Attributes `json:"attributes"`
+	TraceID              string     `json:"traceId"`
+	SpanID               string     `json:"spanId"`
+	EventName            string     `json:"eventName"`
+}
+
+// TracesRequest is an ExportTraceServiceRequest.
+type TracesRequest struct {
+	ResourceSpans []ResourceSpans `json:"resourceSpans"`
+}
+
+type ResourceSpans struct {
+	Resource   Resource     `json:"resource"`
+	ScopeSpans []ScopeSpans `json:"scopeSpans"`
+}
+
+type ScopeSpans struct {
+	Scope Scope  `json:"scope"`
+	Spans []Span `json:"spans"`
+}
+
+type Span struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano Uint64      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   Uint64      `json:"endTimeUnixNano"`
+	Attributes        Attributes  `json:"attributes"`
+	Events            []SpanEvent `json:"events"`
+}
+
+// SpanEvent is a timestamped event of a span, such as a recorded exception.
+type SpanEvent struct {
+	TimeUnixNano Uint64     `json:"timeUnixNano"`
+	Name         string     `json:"name"`
+	Attributes   Attributes `json:"attributes"`
+}
+
+// Resource describes what produced the telemetry, such as a service.
+type Resource struct {
+	Attributes Attributes `json:"attributes"`
+}
+
+// Scope is the instrumentation library that produced the telemetry.
+type Scope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type KeyValue struct {
+	Key   string   `json:"key"`
+	Value AnyValue `json:"value"`
+}
+
+// Attributes are key/value attributes. Keys are unique.
+type Attributes []KeyValue
+
+// Get returns the value of an attribute.
+func (a Attributes) Get(key string) (AnyValue, bool) {
+	for _, kv := range a {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return AnyValue{}, false
+}
+
+// String returns the value of an attribute as a string, or "" if it is not
+// set.
+func (a Attributes) String(key string) string {
+	value, _ := a.Get(key)
+	return value.String()
+}
+
+// AnyValue is an attribute value. At most one field is set.
+type AnyValue struct {
+	StringValue *string       `json:"stringValue,omitempty"`
+	BoolValue   *bool         `json:"boolValue,omitempty"`
+	IntValue    *Int64        `json:"intValue,omitempty"`
+	DoubleValue *float64      `json:"doubleValue,omitempty"`
+	ArrayValue  *ArrayValue   `json:"arrayValue,omitempty"`
+	KvlistValue *KeyValueList `json:"kvlistValue,omitempty"`
+	BytesValue  []byte        `json:"bytesValue,omitempty"`
+}
+
+type ArrayValue struct {
+	Values []AnyValue `json:"values"`
+}
+
+type KeyValueList struct {
+	Values []KeyValue `json:"values"`
+}
+
+// String formats a value. Arrays and key/value lists are formatted as JSON.
+func (v AnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'g', -1, 64)
+	case v.BytesValue != nil:
+		return string(v.BytesValue)
+	case v.ArrayValue != nil, v.KvlistValue != nil:
+		b, _ := json.Marshal(v.Any())
+		return string(b)
+	}
+	return ""
+}
+
+// Any converts a value to the Go value encoding/json would decode it into.
+func (v AnyValue) Any() any {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return float64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.BytesValue != nil:
+		return string(v.BytesValue)
+	case v.ArrayValue != nil:
+		values := make([]any, len(v.ArrayValue.Values))
+		for i, value := range v.ArrayValue.Values {
+			values[i] = value.Any()
+		}
+		return values
+	case v.KvlistValue != nil:
+		values := make(map[string]any, len(v.KvlistValue.Values))
+		for _, kv := range v.KvlistValue.Values {
+			values[kv.Key] = kv.Value.Any()
+		}
+		return values
+	}
+	return nil
+}
+
+// Uint64 is a 64-bit integer, which OTLP/JSON encodes as a string or a
+// number.
+type Uint64 uint64
+
+func (n *Uint64) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseUint(string(bytes.Trim(b, `"`)), 10, 64)
+	*n = Uint64(v)
+	return err
+}
+
+// Time converts a timestamp in nanoseconds since the Unix epoch. It returns
+// the zero time for 0, which means unknown.
+func (n Uint64) Time() time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(n))
+}
+
+// Int64 is a 64-bit integer, which OTLP/JSON encodes as a string or a
+// number.
+type Int64 int64
+
+func (n *Int64) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseInt(string(bytes.Trim(b, `"`)), 10, 64)
+	*n = Int64(v)
+	return err
+}
+
+// DecodeLogs decodes an ExportLogsServiceRequest in the encoding named by
+// contentType.
+func DecodeLogs(body []byte, contentType string) (*LogsRequest, error) {
+	var request LogsRequest
+	switch mediaType(contentType) {
+	case ContentTypeProtobuf:
+		return &request, request.unmarshal(body)
+	case ContentTypeJSON:
+		return &request, json.Unmarshal(body, &request)
+	}
+	return nil, ErrContentType
+}
+
+// DecodeTraces decodes an ExportTraceServiceRequest in the encoding named by
+// contentType.
+func DecodeTraces(body []byte, contentType string) (*TracesRequest, error) {
+	var request TracesRequest
+	switch mediaType(contentType) {
+	case ContentTypeProtobuf:
+		return &request, request.unmarshal(body)
+	case ContentTypeJSON:
+		return &request, json.Unmarshal(body, &request)
+	}
+	return nil, ErrContentType
+}
+
+func mediaType(contentType string) string {
+	media, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(media))
+}
@@ -0,0 +1,145 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// Helpers encoding protobuf fields
+func bytesField(num int, b []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(num<<3|wireBytes))
+	out = binary.AppendUvarint(out, uint64(len(b)))
+	return append(out, b...)
+}
+
+func stringField(num int, s string) []byte {
+	return bytesField(num, []byte(s))
+}
+
+func varintField(num int, n uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, uint64(num<<3|wireVarint)), n)
+}
+
+func fixed64Field(num int, n uint64) []byte {
+	return binary.LittleEndian.AppendUint64(binary.AppendUvarint(nil, uint64(num<<3|wireFixed64)), n)
+}
+
+func message(fields ...[]byte) []byte {
+	var out []byte
+	for _, f := range fields {
+		out = append(out, f...)
+	}
+	return out
+}
+
+func attribute(key string, value []byte) []byte {
+	return message(stringField(1, key), bytesField(2, value))
+}
+
+const logsJSON = `{"resourceLogs":[{"resource":{"attributes":[
+	{"key":"service.name","value":{"stringValue":"checkout"}},
+	{"key":"replicas","value":{"intValue":"3"}}]},
+"scopeLogs":[{"scope":{"name":"app","version":"1.0"},"logRecords":[{
+	"timeUnixNano":"1700000000000000000","severityNumber":17,"severityText":"ERROR",
+	"body":{"stringValue":"charge failed"},
+	"attributes":[
+		{"key":"exception.type","value":{"stringValue":"CardDeclined"}},
+		{"key":"retry","value":{"boolValue":true}},
+		{"key":"amount","value":{"doubleValue":9.5}},
+		{"key":"items","value":{"arrayValue":{"values":[{"stringValue":"tea"},{"intValue":2}]}}},
+		{"key":"card","value":{"kvlistValue":{"values":[{"key":"brand","value":{"stringValue":"visa"}}]}}}],
+	"traceId":"5b8efff798038103d269b633813fc60c","spanId":"eee19b7ec3c1b174"}]}]}]}`
+
+func TestDecodeLogs(t *testing.T) {
+	traceID := []byte{0x5b, 0x8e, 0xff, 0xf7, 0x98, 0x03, 0x81, 0x03, 0xd2, 0x69, 0xb6, 0x33, 0x81, 0x3f, 0xc6, 0x0c}
+	spanID := []byte{0xee, 0xe1, 0x9b, 0x7e, 0xc3, 0xc1, 0xb1, 0x74}
+	record := message(
+		fixed64Field(1, 1700000000000000000),
+		varintField(2, 17),
+		stringField(3, "ERROR"),
+		bytesField(5, stringField(1, "charge failed")),
+		bytesField(6, attribute("exception.type", stringField(1, "CardDeclined"))),
+		bytesField(6, attribute("retry", varintField(2, 1))),
+		bytesField(6, attribute("amount", fixed64Field(4, math.Float64bits(9.5)))),
+		bytesField(6, attribute("items", bytesField(5, message(bytesField(1, stringField(1, "tea")), bytesField(1, varintField(3, 2)))))),
+		bytesField(6, attribute("card", bytesField(6, bytesField(1, attribute("brand", stringField(1, "visa")))))),
+		bytesField(9, traceID),
+		bytesField(10, spanID),
+		// Unknown fields are skipped
+		varintField(99, 1),
+	)
+	body := bytesField(1, message(
+		bytesField(1, message(
+			bytesField(1, attribute("service.name", stringField(1, "checkout"))),
+			bytesField(1, attribute("replicas", varintField(3, 3))),
+		)),
+		bytesField(2, message(bytesField(1, message(stringField(1, "app"), stringField(2, "1.0"))), bytesField(2, record))),
+	))
+
+	fromProtobuf, err := DecodeLogs(body, "application/x-protobuf")
+	if err != nil {
+		t.Fatalf("DecodeLogs(protobuf) error = %v", err)
+	}
+	fromJSON, err := DecodeLogs([]byte(logsJSON), "application/json; charset=utf-8")
+	if err != nil {
+		t.Fatalf("DecodeLogs(json) error = %v", err)
+	}
+	if !reflect.DeepEqual(fromProtobuf, fromJSON) {
+		t.Errorf("Expected both encodings to decode alike; got\n%+v\n%+v", fromProtobuf, fromJSON)
+	}
+
+	got := fromProtobuf.ResourceLogs[0].ScopeLogs[0].LogRecords[0]
+	if got.TraceID != "5b8efff798038103d269b633813fc60c" || got.SpanID != "eee19b7ec3c1b174" || got.Body.String() != "charge failed" || got.TimeUnixNano.Time().Unix() != 1700000000 {
+		t.Errorf("Unexpected record %+v", got)
+	}
+	for key, want := range map[string]string{"exception.type": "CardDeclined", "retry": "true", "amount": "9.5", "items": `["tea",2]`, "card": `{"brand":"visa"}`, "missing": ""} {
+		if value := got.Attributes.String(key); value != want {
+			t.Errorf("Attributes.String(%q) = %q, want %q", key, value, want)
+		}
+	}
+
+	if _, err := DecodeLogs(body[:len(body)-3], ContentTypeProtobuf); err == nil {
+		t.Error("Expected an error for a truncated message")
+	}
+	if _, err := DecodeLogs([]byte("{}"), "text/plain"); !errors.Is(err, ErrContentType) {
+		t.Errorf("Expected ErrContentType; got %v", err)
+	}
+}
+
+func TestDecodeTraces(t *testing.T) {
+	event := message(fixed64Field(1, 1700000000000000000), stringField(2, "exception"), bytesField(3, attribute("exception.message", stringField(1, "boom"))))
+	span := message(bytesField(1, []byte{1, 2}), bytesField(2, []byte{3}), stringField(5, "GET /cart"), varintField(6, 2), bytesField(11, event))
+	body := bytesField(1, bytesField(2, bytesField(2, span)))
+
+	request, err := DecodeTraces(body, ContentTypeProtobuf)
+	if err != nil {
+		t.Fatalf("DecodeTraces() error = %v", err)
+	}
+	got := request.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if got.TraceID != "0102" || got.SpanID != "03" || got.Name != "GET /cart" || got.Kind != 2 || len(got.Events) != 1 || got.Events[0].Attributes.String("exception.message") != "boom" {
+		t.Errorf("Unexpected span %+v", got)
+	}
+
+	// Deeply nested values are refused rather than recursed into
+	value := stringField(1, "leaf")
+	for range maxValueDepth + 1 {
+		value = bytesField(5, bytesField(1, value))
+	}
+	span = message(bytesField(9, attribute("deep", value)))
+	if _, err := DecodeTraces(bytesField(1, bytesField(2, bytesField(2, span))), ContentTypeProtobuf); !errors.Is(err, errDepth) {
+		t.Errorf("Expected errDepth; got %v", err)
+	}
+}
+
+func TestMarshalResponse(t *testing.T) {
+	if got := MarshalResponse(0, ""); len(got) != 0 {
+		t.Errorf("Expected an empty response; got %x", got)
+	}
+	want := bytesField(1, message(varintField(1, 2), stringField(2, "2 records were invalid")))
+	if got := MarshalResponse(2, "2 records were invalid"); !reflect.DeepEqual(got, want) {
+		t.Errorf("MarshalResponse() = %x, want %x", got, want)
+	}
+}
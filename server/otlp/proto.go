@@ -0,0 +1,329 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// How deeply array and key/value list values may nest
+const maxValueDepth = 32
+
+var (
+	errTruncated = errors.New("otlp: truncated protobuf message")
+	errWireType  = errors.New("otlp: invalid protobuf wire type")
+	errDepth     = errors.New("otlp: attribute values nested too deeply")
+)
+
+// field is a field of a protobuf message: the value of a varint or fixed
+// field, or the bytes of a length-delimited one.
+type field struct {
+	num  int
+	wire int
+	n    uint64
+	b    []byte
+}
+
+func (f field) is(num, wire int) bool {
+	return f.num == num && f.wire == wire
+}
+
+// fields calls fn with each field of a message in turn. Fields of unknown
+// numbers are passed too, so fn skips them by ignoring them.
+func fields(b []byte, fn func(field) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 || key>>3 == 0 {
+			return errTruncated
+		}
+		b = b[n:]
+
+		f := field{num: int(key >> 3), wire: int(key & 7)}
+		switch f.wire {
+		case wireVarint:
+			f.n, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errTruncated
+			}
+			f.n = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return errTruncated
+			}
+			f.b = b[n : n+int(length)]
+			b = b[n+int(length):]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			f.n = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			return errWireType
+		}
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *LogsRequest) unmarshal(b []byte) error {
+	return fields(b, func(f field) error {
+		if f.is(1, wireBytes) {
+			r.ResourceLogs = append(r.ResourceLogs, ResourceLogs{})
+			return r.ResourceLogs[len(r.ResourceLogs)-1].unmarshal(f.b)
+		}
+		return nil
+	})
+}
+
+func (r *ResourceLogs) unmarshal(b []byte) error {
+	return fields(b, func(f field) error {
+		switch {
+		case f.is(1, wireBytes):
+			return r.Resource.unmarshal(f.b)
+		case f.is(2, wireBytes):
+			r.ScopeLogs = append(r.ScopeLogs, ScopeLogs{})
+			return r.ScopeLogs[len(r.ScopeLogs)-1].unmarshal(f.b)
+		}
+		return nil
+	})
+}
+
+func (s *ScopeLogs) unmarshal(b []byte) error {
+	return fields(b, func(f field) error {
+		switch {
+		case f.is(1, wireBytes):
+			return s.Scope.unmarshal(f.b)
+		case f.is(2, wireBytes):
+			s.LogRecords = append(s.LogRecords, LogRecord{})
+			return s.LogRecords[len(s.LogRecords)-1].unmarshal(f.b)
+		}
+		return nil
+	})
+}
+
+func (l *LogRecord) unmarshal(b []byte) error {
+	return fields(b, func(f field) error {
+		switch {
+		case f.is(1, wireFixed64):
+			l.TimeUnixNano = Uint64(f.n)
+		case f.is(11, wireFixed64):
+			l.ObservedTimeUnixNano = Uint64(f.n)
+		case f.is(2, wireVarint):
+			l.SeverityNumber = int(f.n)
+		case f.is(3, wireBytes):
+			l.SeverityText = string(f.b)
+		case f.is(5, wireBytes):
+			return l.Body.unmarshal(f.b, 0)
+		case f.is(6, wireBytes):
+			return l.Attributes.unmarshal(f.b, 0)
+		case f.is(9, wireBytes):
+			l.TraceID = hex.EncodeToString(f.b)
+		case f.is(10, wireBytes):
+			l.SpanID = hex.EncodeToString(f.b)
+		case f.is(12, wireBytes):
+			l.EventName = string(f.b)
+		}
+		return nil
+	})
+}
+
+func (r *TracesRequest) unmarshal(b []byte) error {
+	return fields(b, func(f field) error {
+		if f.is(1, wireBytes) {
+			r.ResourceSpans = append(r.ResourceSpans, ResourceSpans{})
+			return r.ResourceSpans[len(r.ResourceSpans)-1].unmarshal(f.b)
+		}
+		return nil
+	})
+}
+
+func (r *ResourceSpans) unmarshal(b []byte) error {
+	return fields(b, func(f field) error {
+		switch {
+		case f.is(1, wireBytes):
+			return r.Resource.unmarshal(f.b)
+		case f.is(2, wireBytes):
+			r.ScopeSpans = append(r.ScopeSpans, ScopeSpans{})
+			return r.ScopeSpans[len(r.ScopeSpans)-1].unmarshal(f.b)
+		}
+		return nil
+	})
+}
+
+func (s *ScopeSpans) unmarshal(b []byte) error {
+	return fields(b, func(f field) error {
+		switch {
+		case f.is(1, wireBytes):
+			return s.Scope.unmarshal(f.b)
+		case f.is(2, wireBytes):
+			s.Spans = append(s.Spans, Span{})
+			return s.Spans[len(s.Spans)-1].unmarshal(f.b)
+		}
+		return nil
+	})
+}
+
+func (s *Span) unmarshal(b []byte) error {
+	return fields(b, func(f field) error {
+		switch {
+		case f.is(1, wireBytes):
+			s.TraceID = hex.EncodeToString(f.b)
+		case f.is(2, wireBytes):
+			s.SpanID = hex.EncodeToString(f.b)
+		case f.is(4, wireBytes):
+			s.ParentSpanID = hex.EncodeToString(f.b)
+		case f.is(5, wireBytes):
+			s.Name = string(f.b)
+		case f.is(6, wireVarint):
+			s.Kind = int(f.n)
+		case f.is(7, wireFixed64):
+			s.StartTimeUnixNano = Uint64(f.n)
+		case f.is(8, wireFixed64):
+			s.EndTimeUnixNano = Uint64(f.n)
+		case f.is(9, wireBytes):
+			return s.Attributes.unmarshal(f.b, 0)
+		case f.is(11, wireBytes):
+			s.Events = append(s.Events, SpanEvent{})
+			return s.Events[len(s.Events)-1].unmarshal(f.b)
+		}
+		return nil
+	})
+}
+
+func (e *SpanEvent) unmarshal(b []byte) error {
+	return fields(b, func(f field) error {
+		switch {
+		case f.is(1, wireFixed64):
+			e.TimeUnixNano = Uint64(f.n)
+		case f.is(2, wireBytes):
+			e.Name = string(f.b)
+		case f.is(3, wireBytes):
+			return e.Attributes.unmarshal(f.b, 0)
+		}
+		return nil
+	})
+}
+
+func (r *Resource) unmarshal(b []byte) error {
+	return fields(b, func(f field) error {
+		if f.is(1, wireBytes) {
+			return r.Attributes.unmarshal(f.b, 0)
+		}
+		return nil
+	})
+}
+
+func (s *Scope) unmarshal(b []byte) error {
+	return fields(b, func(f field) error {
+		switch {
+		case f.is(1, wireBytes):
+			s.Name = string(f.b)
+		case f.is(2, wireBytes):
+			s.Version = string(f.b)
+		}
+		return nil
+	})
+}
+
+// unmarshal appends one encoded KeyValue to the attributes.
+func (a *Attributes) unmarshal(b []byte, depth int) error {
+	var kv KeyValue
+	err := fields(b, func(f field) error {
+		switch {
+		case f.is(1, wireBytes):
+			kv.Key = string(f.b)
+		case f.is(2, wireBytes):
+			return kv.Value.unmarshal(f.b, depth)
+		}
+		return nil
+	})
+	*a = append(*a, kv)
+	return err
+}
+
+func (v *AnyValue) unmarshal(b []byte, depth int) error {
+	if depth >= maxValueDepth {
+		return errDepth
+	}
+	return fields(b, func(f field) error {
+		switch {
+		case f.is(1, wireBytes):
+			s := string(f.b)
+			v.StringValue = &s
+		case f.is(2, wireVarint):
+			value := f.n != 0
+			v.BoolValue = &value
+		case f.is(3, wireVarint):
+			value := Int64(f.n)
+			v.IntValue = &value
+		case f.is(4, wireFixed64):
+			value := math.Float64frombits(f.n)
+			v.DoubleValue = &value
+		case f.is(5, wireBytes):
+			v.ArrayValue = &ArrayValue{}
+			return fields(f.b, func(f field) error {
+				if f.is(1, wireBytes) {
+					v.ArrayValue.Values = append(v.ArrayValue.Values, AnyValue{})
+					return v.ArrayValue.Values[len(v.ArrayValue.Values)-1].unmarshal(f.b, depth+1)
+				}
+				return nil
+			})
+		case f.is(6, wireBytes):
+			var values Attributes
+			err := fields(f.b, func(f field) error {
+				if f.is(1, wireBytes) {
+					return values.unmarshal(f.b, depth+1)
+				}
+				return nil
+			})
+			v.KvlistValue = &KeyValueList{Values: values}
+			return err
+		case f.is(7, wireBytes):
+			v.BytesValue = append([]byte{}, f.b...)
+		}
+		return nil
+	})
+}
+
+// MarshalResponse encodes an ExportLogsServiceResponse or
+// ExportTraceServiceResponse, which share their layout. A response that
+// rejected nothing is empty.
+func MarshalResponse(rejected int64, message string) []byte {
+	if rejected == 0 && message == "" {
+		return []byte{}
+	}
+	partial := make([]byte, 0, 16+len(message))
+	if rejected != 0 {
+		partial = binary.AppendUvarint(partial, 1<<3|wireVarint)
+		partial = binary.AppendUvarint(partial, uint64(rejected))
+	}
+	if message != "" {
+		partial = binary.AppendUvarint(partial, 2<<3|wireBytes)
+		partial = binary.AppendUvarint(partial, uint64(len(message)))
+		partial = append(partial, message...)
+	}
+
+	response := binary.AppendUvarint(nil, 1<<3|wireBytes)
+	response = binary.AppendUvarint(response, uint64(len(partial)))
+	return append(response, partial...)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"tjseabury/overlord/types"
+)
+
+var (
+	errBodyTooLarge        = errors.New("request body too large")
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+)
+
+// FieldLimits are the longest values, in bytes, stored for free-form fields.
+// Zero disables a limit.
+type FieldLimits struct {
+	ErrorText  int
+	StackTrace int
+	URL        int
+	// The most breadcrumbs kept per event, newest first; their messages
+	// share the ErrorText limit
+	Breadcrumbs int
+}
+
+// truncate cuts s to at most n bytes without splitting a UTF-8 character.
+func truncate(s string, n int) (string, bool) {
+	if n <= 0 || len(s) <= n {
+		return s, false
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n], true
+}
+
+// Apply truncates the free-form fields of a payload and reports whether any
+// of them were cut.
+func (l FieldLimits) Apply(data *types.ErrorDetails) bool {
+	var errorText, stackTrace, url bool
+	data.ErrorText, errorText = truncate(data.ErrorText, l.ErrorText)
+	data.StackTrace, stackTrace = truncate(data.StackTrace, l.StackTrace)
+	data.URL, url = truncate(data.URL, l.URL)
+
+	breadcrumbs := false
+	if l.Breadcrumbs > 0 && len(data.Breadcrumbs) > l.Breadcrumbs {
+		data.Breadcrumbs = data.Breadcrumbs[len(data.Breadcrumbs)-l.Breadcrumbs:]
+		breadcrumbs = true
+	}
+	for i := range data.Breadcrumbs {
+		var cut bool
+		data.Breadcrumbs[i].Message, cut = truncate(data.Breadcrumbs[i].Message, l.ErrorText)
+		breadcrumbs = breadcrumbs || cut
+	}
+
+	return errorText || stackTrace || url || breadcrumbs
+}
+
+// readBody reads an ingestion request body, transparently decompressing
+// gzip and deflate bodies. Both the compressed and decompressed sizes are
+// capped at limit bytes.
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	body := http.MaxBytesReader(w, r.Body, limit)
+	defer body.Close()
+
+	var reader io.Reader
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		reader = body
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, maxBytesError(err)
+		}
+		defer gz.Close()
+		reader = gz
+	case "deflate":
+		// HTTP deflate is zlib-wrapped, but some clients send raw deflate
+		compressed, err := io.ReadAll(body)
+		if err != nil {
+			return nil, maxBytesError(err)
+		}
+		if zr, err := zlib.NewReader(bytes.NewReader(compressed)); err == nil {
+			defer zr.Close()
+			reader = zr
+		} else {
+			fr := flate.NewReader(bytes.NewReader(compressed))
+			defer fr.Close()
+			reader = fr
+		}
+	default:
+		return nil, errUnsupportedEncoding
+	}
+
+	// Read one byte past the limit to detect oversized bodies
+	data, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, maxBytesError(err)
+	}
+	if int64(len(data)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return data, nil
+}
+
+func maxBytesError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return errBodyTooLarge
+	}
+	return err
+}
+
+// writeBodyError responds to a body that readBody could not read.
+func writeBodyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errUnsupportedEncoding):
+		http.Error(w, "Unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+	default:
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+	}
+}
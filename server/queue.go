@@ -0,0 +1,172 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// OutcomeQueueFull counts events shed because the ingestion queue was full
+const OutcomeQueueFull = "queue_full"
+
+// How long clients are asked to wait when the queue is full
+const queueRetryAfter = 5 * time.Second
+
+// IngestQueue decouples ingestion requests from database writes. Handlers
+// enqueue the validated events of a request as one unit and a pool of
+// workers writes each unit in its own transaction, so a batch request is
+// stored all or nothing and never fails because of another request. Each
+// property's units always go to the same worker, so they are grouped into
+// issues in the order they arrived and two workers never race to create the
+// same issue.
+type IngestQueue struct {
+	DB       *gorm.DB
+	Capacity int
+
+	shards  []chan []IngestedEvent
+	depth   atomic.Int64
+	workers sync.WaitGroup
+
+	// Guards closed, pending and sends on the shards, so nothing is sent
+	// after Close
+	mu      sync.Mutex
+	closed  bool
+	pending int
+	// Signalled when pending drops to zero
+	drained *sync.Cond
+
+	enqueued atomic.Int64
+	dropped  atomic.Int64
+	written  atomic.Int64
+	failed   atomic.Int64
+}
+
+// QueueStats is a snapshot of the queue's depth and counters.
+type QueueStats struct {
+	Depth    int   `json:"depth"`
+	Capacity int   `json:"capacity"`
+	Enqueued int64 `json:"enqueued"`
+	Dropped  int64 `json:"dropped"`
+	Written  int64 `json:"written"`
+	Failed   int64 `json:"failed"`
+}
+
+// NewIngestQueue starts a queue holding up to capacity events, written by
+// the given number of workers.
+func NewIngestQueue(db *gorm.DB, capacity, workers int) *IngestQueue {
+	q := &IngestQueue{
+		DB:       db,
+		Capacity: max(capacity, 1),
+	}
+	q.drained = sync.NewCond(&q.mu)
+	for i := 0; i < max(workers, 1); i++ {
+		// Every shard can hold the whole capacity, so sends never block
+		shard := make(chan []IngestedEvent, q.Capacity)
+		q.shards = append(q.shards, shard)
+		q.workers.Add(1)
+		go q.work(shard)
+	}
+	return q
+}
+
+func newIngestQueueFromConfig(db *gorm.DB) *IngestQueue {
+	return NewIngestQueue(
+		db,
+		configInt("INGEST_QUEUE_SIZE", 10000),
+		configInt("INGEST_WORKERS", 2),
+	)
+}
+
+// Enqueue adds the events of a request to the queue as one unit, or refuses
+// them all if there is not enough room or the queue is closed. The events
+// must belong to a single property.
+func (q *IngestQueue) Enqueue(events []IngestedEvent) bool {
+	if len(events) == 0 {
+		return true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Only workers lower the depth, so the free space can only grow while
+	// we hold the lock.
+	if q.closed || int(q.depth.Load())+len(events) > q.Capacity {
+		q.dropped.Add(int64(len(events)))
+		return false
+	}
+
+	q.pending += len(events)
+	q.depth.Add(int64(len(events)))
+	q.shards[events[0].WebPropertyID%len(q.shards)] <- events
+	q.enqueued.Add(int64(len(events)))
+	return true
+}
+
+func (q *IngestQueue) work(shard chan []IngestedEvent) {
+	defer q.workers.Done()
+
+	for events := range shard {
+		q.depth.Add(-int64(len(events)))
+		if err := storeEvents(q.DB, events); err != nil {
+			log.Printf("Error writing %d queued events: %v", len(events), err)
+			q.failed.Add(int64(len(events)))
+		} else {
+			q.written.Add(int64(len(events)))
+		}
+
+		q.mu.Lock()
+		q.pending -= len(events)
+		if q.pending == 0 {
+			q.drained.Broadcast()
+		}
+		q.mu.Unlock()
+	}
+}
+
+// Flush blocks until every event enqueued so far has been written.
+func (q *IngestQueue) Flush() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.pending > 0 {
+		q.drained.Wait()
+	}
+}
+
+// Close stops accepting events and waits for the queue to drain.
+func (q *IngestQueue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, shard := range q.shards {
+			close(shard)
+		}
+	}
+	q.mu.Unlock()
+
+	q.workers.Wait()
+}
+
+func (q *IngestQueue) Stats() QueueStats {
+	return QueueStats{
+		Depth:    int(q.depth.Load()),
+		Capacity: q.Capacity,
+		Enqueued: q.enqueued.Load(),
+		Dropped:  q.dropped.Load(),
+		Written:  q.written.Load(),
+		Failed:   q.failed.Load(),
+	}
+}
+
+func writeServiceUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(queueRetryAfter.Seconds())))
+	http.Error(w, "Ingestion queue is full", http.StatusServiceUnavailable)
+}
+
+func (router *Router) api_ingest_queue_stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, router.Queue.Stats())
+}
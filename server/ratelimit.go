@@ -0,0 +1,293 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Ingestion outcomes recorded in IngestionStat
+const (
+	OutcomeAccepted      = "accepted"
+	OutcomeInvalid       = "invalid"
+	OutcomeRateLimited   = "rate_limited"
+	OutcomeQuotaExceeded = "quota_exceeded"
+)
+
+// The number of idle buckets a limiter keeps before sweeping them
+const maxIdleBuckets = 10000
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a token bucket limiter keyed by an arbitrary string, such
+// as an ingestion token or a client IP. A limiter with a zero rate allows
+// everything.
+type RateLimiter struct {
+	Rate  float64 // tokens added per second
+	Burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func NewRateLimiter(perMinute, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		Rate:    float64(perMinute) / 60,
+		Burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the key's bucket. When the bucket is empty it
+// returns false and how long until a token is available.
+func (rl *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if rl == nil || rl.Rate <= 0 {
+		return true, 0
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	b, ok := rl.buckets[key]
+	if !ok {
+		if len(rl.buckets) >= maxIdleBuckets {
+			rl.sweep(now)
+		}
+		b = &bucket{tokens: rl.Burst, last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = math.Min(rl.Burst, b.tokens+now.Sub(b.last).Seconds()*rl.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / rl.Rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep forgets buckets that have refilled, as they behave like new ones.
+func (rl *RateLimiter) sweep(now time.Time) {
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.Rate >= rl.Burst {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// IngestionLimits are the rate and size limits applied to every ingestion
+// request.
+type IngestionLimits struct {
+	PerToken *RateLimiter
+	PerIP    *RateLimiter
+	// Trust X-Forwarded-For when Overlord runs behind a reverse proxy
+	TrustProxy bool
+
+	// The largest decompressed request bodies, in bytes
+	MaxBodyBytes      int64
+	MaxBatchBodyBytes int64
+	// Longer fields are truncated and the event is flagged as truncated
+	Fields FieldLimits
+	Tags   TagLimits
+}
+
+func newIngestionLimits() *IngestionLimits {
+	return &IngestionLimits{
+		PerToken:          NewRateLimiter(configInt("RATE_LIMIT_TOKEN_PER_MINUTE", 600), configInt("RATE_LIMIT_TOKEN_BURST", 100)),
+		PerIP:             NewRateLimiter(configInt("RATE_LIMIT_IP_PER_MINUTE", 120), configInt("RATE_LIMIT_IP_BURST", 30)),
+		TrustProxy:        APP_CONFIG["TRUST_PROXY"] == "TRUE",
+		MaxBodyBytes:      int64(configInt("MAX_BODY_BYTES", 1<<20)),
+		MaxBatchBodyBytes: int64(configInt("MAX_BATCH_BODY_BYTES", 10<<20)),
+		Fields: FieldLimits{
+			ErrorText:   configInt("MAX_ERROR_TEXT_LENGTH", 4096),
+			StackTrace:  configInt("MAX_STACK_TRACE_LENGTH", 64<<10),
+			URL:         configInt("MAX_URL_LENGTH", 4096),
+			Breadcrumbs: configInt("MAX_BREADCRUMBS", 100),
+		},
+		Tags: TagLimits{
+			MaxTags:        configInt("MAX_TAGS", 50),
+			MaxKeyLength:   configInt("MAX_TAG_KEY_LENGTH", 32),
+			MaxValueLength: configInt("MAX_TAG_VALUE_LENGTH", 200),
+			MaxExtraBytes:  configInt("MAX_EXTRA_BYTES", 16<<10),
+		},
+	}
+}
+
+func (l *IngestionLimits) clientIP(r *http.Request) string {
+	if l.TrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// IngestionStat counts the events of a property that were accepted or
+// dropped on a given day, by outcome. Requests rejected by a rate limit are
+// counted per request, as their bodies are never read.
+type IngestionStat struct {
+	ID            uint   `gorm:"primarykey" json:"-"`
+	WebPropertyID uint   `gorm:"not null;uniqueIndex:idx_ingestion_stat" json:"webPropertyId"`
+	Day           string `gorm:"size:10;not null;uniqueIndex:idx_ingestion_stat" json:"day"`
+	Outcome       string `gorm:"size:64;not null;uniqueIndex:idx_ingestion_stat" json:"outcome"`
+	Total         int    `gorm:"not null;default:0" json:"total"`
+}
+
+func statDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// recordOutcome adds n to today's count of an outcome for a property.
+func recordOutcome(db *gorm.DB, propertyID uint, outcome string, n int) error {
+	if n == 0 {
+		return nil
+	}
+	stat := IngestionStat{
+		WebPropertyID: propertyID,
+		Day:           statDay(time.Now()),
+		Outcome:       outcome,
+		Total:         n,
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "web_property_id"}, {Name: "day"}, {Name: "outcome"}},
+		DoUpdates: clause.Assignments(map[string]any{"total": gorm.Expr("total + ?", n)}),
+	}).Create(&stat).Error
+}
+
+// Quotas tracks how much of their daily quota properties have used today.
+// Events are counted when they are queued rather than once they are
+// written, so that those still waiting in the queue count too.
+type Quotas struct {
+	db   *gorm.DB
+	mu   sync.Mutex
+	day  string
+	used map[uint]int
+}
+
+func newQuotas(db *gorm.DB) *Quotas {
+	return &Quotas{db: db, used: make(map[uint]int)}
+}
+
+// Reserve takes up to n events from a property's quota for today and
+// returns how many it got. Properties without a quota get all n, but they
+// are still counted in case a quota is set later in the day.
+func (q *Quotas) Reserve(property *WebProperty, n int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if day := statDay(time.Now()); day != q.day {
+		q.day = day
+		q.used = make(map[uint]int)
+	}
+	used, ok := q.used[property.ID]
+	if !ok {
+		// Start from what was stored today before the server started
+		var stat IngestionStat
+		q.db.Where("web_property_id = ? AND day = ? AND outcome = ?", property.ID, q.day, OutcomeAccepted).First(&stat)
+		used = stat.Total
+	}
+	reserved := n
+	if property.DailyQuota > 0 {
+		reserved = min(n, max(property.DailyQuota-used, 0))
+	}
+	q.used[property.ID] = used + reserved
+	return reserved
+}
+
+// Release gives back reserved events that were not queued after all.
+func (q *Quotas) Release(propertyID uint, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if used, ok := q.used[propertyID]; ok {
+		q.used[propertyID] = max(used-n, 0)
+	}
+}
+
+// untilTomorrow is how long until daily quotas reset at midnight UTC.
+func untilTomorrow() time.Duration {
+	now := time.Now().UTC()
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return tomorrow.Sub(now)
+}
+
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
+
+// admitIngestion authenticates an ingestion request by its token, checks
+// its origin and applies the per-IP and per-token rate limits. It writes the error
+// response itself and returns false when the request must not be processed.
+func (router *Router) admitIngestion(w http.ResponseWriter, r *http.Request) (WebProperty, bool) {
+	return router.admitToken(w, r, r.Header.Get("X-ACCESS-TOKEN"))
+}
+
+// admitToken is admitIngestion for endpoints that carry the ingestion token
+// somewhere other than the X-ACCESS-TOKEN header.
+func (router *Router) admitToken(w http.ResponseWriter, r *http.Request, token string) (WebProperty, bool) {
+	// Limit by IP first so token guessing cannot hammer the database
+	if ok, wait := router.Limits.PerIP.Allow(router.Limits.clientIP(r)); !ok {
+		writeTooManyRequests(w, wait, "Too Many Requests")
+		return WebProperty{}, false
+	}
+
+	// Look up the web property the ingestion token belongs to
+	property, err := router.WebPropertyDB.FindByToken(token)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return WebProperty{}, false
+	}
+
+	if !router.admitOrigin(w, r, &property) {
+		return WebProperty{}, false
+	}
+
+	if ok, wait := router.Limits.PerToken.Allow(property.Token); !ok {
+		recordOutcome(router.DB, property.ID, OutcomeRateLimited, 1)
+		writeTooManyRequests(w, wait, "Too Many Requests")
+		return WebProperty{}, false
+	}
+
+	return property, true
+}
+
+func (router *Router) api_web_property_stats(w http.ResponseWriter, r *http.Request) {
+	property, ok := router.webPropertyFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days < 1 {
+		days = 7
+	}
+	since := statDay(time.Now().AddDate(0, 0, 1-days))
+
+	stats := make([]IngestionStat, 0)
+	router.DB.Where("web_property_id = ? AND day >= ?", property.ID, since).Order("day, outcome").Find(&stats)
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Release is a build of a web property that has reported events.
+type Release struct {
+	ID            uint      `gorm:"primarykey" json:"id"`
+	WebPropertyID uint      `gorm:"not null;uniqueIndex:idx_release_version" json:"webPropertyId"`
+	Version       string    `gorm:"size:255;not null;uniqueIndex:idx_release_version" json:"version"`
+	Events        int       `gorm:"not null;default:0" json:"events"`
+	FirstSeen     time.Time `gorm:"not null" json:"firstSeen"`
+	LastSeen      time.Time `gorm:"not null" json:"lastSeen"`
+}
+
+// Environment is where a web property runs, such as production or staging.
+type Environment struct {
+	ID            uint      `gorm:"primarykey" json:"id"`
+	WebPropertyID uint      `gorm:"not null;uniqueIndex:idx_environment_name" json:"webPropertyId"`
+	Name          string    `gorm:"size:255;not null;uniqueIndex:idx_environment_name" json:"name"`
+	Events        int       `gorm:"not null;default:0" json:"events"`
+	FirstSeen     time.Time `gorm:"not null" json:"firstSeen"`
+	LastSeen      time.Time `gorm:"not null" json:"lastSeen"`
+}
+
+type propertyValue struct {
+	propertyID uint
+	value      string
+}
+
+// countValues counts the events of each property by a non-empty value.
+func countValues(events []IngestedEvent, value func(*IngestedEvent) string) map[propertyValue]int {
+	counts := make(map[propertyValue]int)
+	for i := range events {
+		if v := value(&events[i]); v != "" {
+			counts[propertyValue{uint(events[i].WebPropertyID), v}]++
+		}
+	}
+	return counts
+}
+
+// recordReleases creates or bumps the releases and environments the events
+// were reported from.
+func recordReleases(tx *gorm.DB, events []IngestedEvent) error {
+	now := time.Now()
+	bump := func(n int) clause.Set {
+		return clause.Assignments(map[string]any{
+			"events":    gorm.Expr("events + ?", n),
+			"last_seen": now,
+		})
+	}
+
+	releases := countValues(events, func(e *IngestedEvent) string { return e.Release })
+	for key, n := range releases {
+		release := Release{WebPropertyID: key.propertyID, Version: key.value, Events: n, FirstSeen: now, LastSeen: now}
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "web_property_id"}, {Name: "version"}},
+			DoUpdates: bump(n),
+		}).Create(&release).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	environments := countValues(events, func(e *IngestedEvent) string { return e.Environment })
+	for key, n := range environments {
+		environment := Environment{WebPropertyID: key.propertyID, Name: key.value, Events: n, FirstSeen: now, LastSeen: now}
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "web_property_id"}, {Name: "name"}},
+			DoUpdates: bump(n),
+		}).Create(&environment).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listReleases returns the releases of a property, or of every property if
+// propertyID is zero, with the most recently seen first.
+func listReleases(db *gorm.DB, propertyID uint) []Release {
+	releases := make([]Release, 0)
+	query := db.Order("last_seen desc")
+	if propertyID != 0 {
+		query = query.Where("web_property_id = ?", propertyID)
+	}
+	query.Find(&releases)
+	return releases
+}
+
+// listEnvironments returns the environments of a property, or of every
+// property if propertyID is zero, by name.
+func listEnvironments(db *gorm.DB, propertyID uint) []Environment {
+	environments := make([]Environment, 0)
+	query := db.Order("name")
+	if propertyID != 0 {
+		query = query.Where("web_property_id = ?", propertyID)
+	}
+	query.Find(&environments)
+	return environments
+}
+
+func (router *Router) api_list_releases(w http.ResponseWriter, r *http.Request) {
+	property, ok := router.webPropertyFromPath(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, listReleases(router.DB, property.ID))
+}
+
+func (router *Router) api_list_environments(w http.ResponseWriter, r *http.Request) {
+	property, ok := router.webPropertyFromPath(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, listEnvironments(router.DB, property.ID))
+}
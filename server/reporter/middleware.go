@@ -0,0 +1,77 @@
+package reporter
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"tjseabury/overlord/types"
+)
+
+// CapturePanic reports a value recovered from a panic, with the stack of
+// the goroutine that panicked. It must be called from the deferred function
+// that recovered.
+func (c *Client) CapturePanic(value any, options ...Option) bool {
+	data := types.ErrorDetails{StackTrace: string(debug.Stack())}
+	if err, ok := value.(error); ok {
+		data.ErrorText = err.Error()
+	} else {
+		data.ErrorText = fmt.Sprint(value)
+	}
+	data.Filename, data.Line = panicLocation(data.StackTrace)
+	data.ErrorText = "panic: " + data.ErrorText
+
+	WithTags(map[string]string{"panic.type": fmt.Sprintf("%T", value)})(&data)
+	for _, option := range options {
+		option(&data)
+	}
+	return c.Send(data)
+}
+
+// panicLocation finds where a panic happened in a debug.Stack trace: the
+// first frame after the call to panic that is not in the runtime, which
+// raises panics such as nil dereferences itself.
+func panicLocation(trace string) (string, int) {
+	lines := strings.Split(trace, "\n")
+	for i := range lines {
+		if !strings.HasPrefix(lines[i], "panic(") {
+			continue
+		}
+		// Frames are a function line followed by a location line
+		for j := i + 2; j+1 < len(lines); j += 2 {
+			if strings.HasPrefix(lines[j], "runtime.") {
+				continue
+			}
+			location := strings.TrimSpace(lines[j+1])
+			location, _, _ = strings.Cut(location, " +0x")
+			if k := strings.LastIndexByte(location, ':'); k > 0 {
+				line, _ := strconv.Atoi(location[k+1:])
+				return location[:k], line
+			}
+			return location, 0
+		}
+	}
+	return "", 0
+}
+
+// Middleware recovers panics in next, reports them with the request they
+// happened in and responds with a 500. The http.ErrAbortHandler panic used
+// to abort a response is passed on.
+func (c *Client) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			value := recover()
+			if value == nil {
+				return
+			}
+			if value == http.ErrAbortHandler {
+				panic(value)
+			}
+			c.CapturePanic(value, WithRequest(r))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
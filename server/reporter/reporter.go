@@ -0,0 +1,490 @@
+// Package reporter reports errors from Go programs to an Overlord server.
+// Events are queued and sent in batches from a background goroutine, so
+// reporting never blocks the caller.
+//
+//	client, err := reporter.New(reporter.Config{
+//		Endpoint: "https://overlord.example.com",
+//		Token:    "<ingestion token>",
+//		Domain:   "api.example.com",
+//	})
+//	defer client.Close(context.Background())
+//
+//	client.CaptureError(err, reporter.WithRequest(r))
+package reporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tjseabury/overlord/types"
+)
+
+// Version is the version of this package, sent in the user agent of events
+// that were not reported from a request.
+const Version = "0.1.0"
+
+// The longest the client waits before retrying a batch. Batches the server
+// asks to hold back for longer are given up on.
+const maxRetryWait = time.Minute
+
+// Config configures a Client. Only Endpoint and Token are required.
+type Config struct {
+	// The base URL of the Overlord server
+	Endpoint string
+	// The ingestion token of the web property to report to
+	Token string
+	// The domain events are reported from; defaults to the host name
+	Domain      string
+	Release     string
+	Environment string
+	// Tags added to every event
+	Tags map[string]string
+
+	// How many events may wait to be sent before new ones are dropped
+	BufferSize int
+	// The most events sent in one request
+	BatchSize int
+	// How long an event may wait for its batch to fill up
+	FlushInterval time.Duration
+	// How many times a batch is retried when the server is unavailable.
+	// Zero means 3; a negative number disables retries. Waits between
+	// retries are capped at a minute.
+	MaxRetries int
+	// The first delay between retries, doubled on every attempt
+	RetryBackoff time.Duration
+
+	HTTPClient *http.Client
+	// Called with errors sending events, which are otherwise dropped
+	// silently. Events the server refused are passed one by one as a
+	// *RejectedError.
+	OnError func(error)
+}
+
+// RejectedError is an event the server refused, with its reasons.
+type RejectedError struct {
+	Event  types.ErrorDetails
+	Errors types.ValidationErrors
+}
+
+func (e *RejectedError) Error() string {
+	return "reporter: event rejected: " + e.Errors.Error()
+}
+
+func (e *RejectedError) Unwrap() error { return e.Errors }
+
+// Client queues events and sends them to Overlord. It is safe for
+// concurrent use.
+type Client struct {
+	config    Config
+	batchURL  string
+	userAgent string
+
+	queue   chan types.ErrorDetails
+	workers sync.WaitGroup
+	pending sync.WaitGroup
+	mu      sync.RWMutex
+	closed  bool
+
+	sent    atomic.Int64
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+// Stats counts what happened to the events given to a Client.
+type Stats struct {
+	Sent    int64
+	Dropped int64
+	Failed  int64
+}
+
+// New starts a Client.
+func New(config Config) (*Client, error) {
+	if config.Token == "" {
+		return nil, errors.New("reporter: a token is required")
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("reporter: invalid endpoint %q", config.Endpoint)
+	}
+
+	if config.Domain == "" {
+		config.Domain, _ = os.Hostname()
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = 1000
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 50
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = time.Second
+	}
+	if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	} else if config.MaxRetries == 0 {
+		config.MaxRetries = 3
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = 500 * time.Millisecond
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	c := &Client{
+		config:    config,
+		batchURL:  endpoint.JoinPath("api", "report-error", "batch").String(),
+		userAgent: fmt.Sprintf("overlord-go/%s (%s; %s/%s)", Version, runtime.Version(), runtime.GOOS, runtime.GOARCH),
+		queue:     make(chan types.ErrorDetails, config.BufferSize),
+	}
+	c.workers.Add(1)
+	go c.work()
+	return c, nil
+}
+
+// Send queues an event, filling in whatever the client's configuration
+// provides. It returns false if the event was dropped because the queue is
+// full or the client is closed.
+func (c *Client) Send(data types.ErrorDetails) bool {
+	c.complete(&data)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		c.dropped.Add(1)
+		return false
+	}
+
+	c.pending.Add(1)
+	select {
+	case c.queue <- data:
+		return true
+	default:
+		c.pending.Done()
+		c.dropped.Add(1)
+		return false
+	}
+}
+
+// complete fills in the fields of an event that Overlord requires. Go has
+// no column numbers, so those are always 1.
+func (c *Client) complete(data *types.ErrorDetails) {
+	if data.Domain == "" {
+		data.Domain = c.config.Domain
+	}
+	if data.URL == "" {
+		data.URL = "https://" + data.Domain + "/"
+	}
+	if data.Filename == "" {
+		data.Filename = "unknown"
+	}
+	data.Line = max(data.Line, 1)
+	data.Column = max(data.Column, 1)
+	if data.Datetime == "" {
+		data.Datetime = time.Now().UTC().Format(time.RFC3339)
+	}
+	if data.UserAgent == "" {
+		data.UserAgent = c.userAgent
+	}
+	if data.Release == "" {
+		data.Release = c.config.Release
+	}
+	if data.Environment == "" {
+		data.Environment = c.config.Environment
+	}
+	if len(c.config.Tags) > 0 {
+		tags := make(map[string]string, len(c.config.Tags)+len(data.Tags))
+		for key, value := range c.config.Tags {
+			tags[key] = value
+		}
+		for key, value := range data.Tags {
+			tags[key] = value
+		}
+		data.Tags = tags
+	}
+}
+
+// Flush blocks until every event queued so far has been sent or given up
+// on, or until the context is done.
+func (c *Client) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting events and sends the ones still queued, waiting
+// until they are sent or the context is done.
+func (c *Client) Close(ctx context.Context) error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) Stats() Stats {
+	return Stats{
+		Sent:    c.sent.Load(),
+		Dropped: c.dropped.Load(),
+		Failed:  c.failed.Load(),
+	}
+}
+
+func (c *Client) work() {
+	defer c.workers.Done()
+
+	ticker := time.NewTicker(c.config.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]types.ErrorDetails, 0, c.config.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		result, err := c.post(batch)
+		if err != nil {
+			c.failed.Add(int64(len(batch)))
+			c.onError(err)
+		} else {
+			rejected := 0
+			for _, item := range result.Results {
+				if item.Accepted || item.Index < 0 || item.Index >= len(batch) {
+					continue
+				}
+				rejected++
+				c.onError(&RejectedError{Event: batch[item.Index], Errors: item.Errors})
+			}
+			c.sent.Add(int64(len(batch) - rejected))
+			c.failed.Add(int64(rejected))
+		}
+		c.pending.Add(-len(batch))
+		batch = make([]types.ErrorDetails, 0, c.config.BatchSize)
+	}
+
+	for {
+		select {
+		case data, ok := <-c.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, data)
+			if len(batch) >= c.config.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (c *Client) onError(err error) {
+	if c.config.OnError != nil {
+		c.config.OnError(err)
+	}
+}
+
+// errRetry marks a failed request that may succeed if it is sent again.
+type errRetry struct {
+	err   error
+	after time.Duration
+}
+
+func (e *errRetry) Error() string { return e.err.Error() }
+
+// post sends a batch, retrying with exponential backoff while the server
+// is unreachable, rate limiting or unavailable. It returns the server's
+// result for each item of the batch.
+func (c *Client) post(batch []types.ErrorDetails) (types.BatchResult, error) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	if err := json.NewEncoder(gz).Encode(batch); err != nil {
+		return types.BatchResult{}, fmt.Errorf("reporter: encoding events: %w", err)
+	}
+	gz.Close()
+
+	backoff := c.config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		result, err := c.attempt(body.Bytes())
+		var retry *errRetry
+		if !errors.As(err, &retry) {
+			return result, err
+		}
+		// A server out of quota asks to wait until midnight, which would
+		// hold up every event queued behind this batch
+		if attempt >= c.config.MaxRetries || retry.after > maxRetryWait {
+			return types.BatchResult{}, retry.err
+		}
+		wait := min(max(retry.after, backoff), maxRetryWait)
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+func (c *Client) attempt(body []byte) (types.BatchResult, error) {
+	var result types.BatchResult
+	req, err := http.NewRequest(http.MethodPost, c.batchURL, bytes.NewReader(body))
+	if err != nil {
+		return result, fmt.Errorf("reporter: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("X-ACCESS-TOKEN", c.config.Token)
+	req.Header.Set("User-Agent", c.userAgent)
+
+	resp, err := c.config.HTTPClient.Do(req)
+	if err != nil {
+		return result, &errRetry{err: fmt.Errorf("reporter: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		// The batch was received, but items may still have been rejected.
+		// Without a result every item counts as accepted.
+		json.NewDecoder(resp.Body).Decode(&result)
+		return result, nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return result, &errRetry{
+			err:   fmt.Errorf("reporter: server responded %s", resp.Status),
+			after: time.Duration(seconds) * time.Second,
+		}
+	}
+	return result, fmt.Errorf("reporter: server responded %s", resp.Status)
+}
+
+// Option adds context to a captured event.
+type Option func(*types.ErrorDetails)
+
+// WithTags adds searchable tags to an event.
+func WithTags(tags map[string]string) Option {
+	return func(data *types.ErrorDetails) {
+		if data.Tags == nil {
+			data.Tags = make(map[string]string, len(tags))
+		}
+		for key, value := range tags {
+			data.Tags[key] = value
+		}
+	}
+}
+
+// WithExtra adds free-form context to an event.
+func WithExtra(extra map[string]any) Option {
+	return func(data *types.ErrorDetails) {
+		if data.Extra == nil {
+			data.Extra = make(map[string]any, len(extra))
+		}
+		for key, value := range extra {
+			data.Extra[key] = value
+		}
+	}
+}
+
+// WithRequest reports an event as having happened while serving r, from
+// the domain of its host.
+func WithRequest(r *http.Request) Option {
+	return func(data *types.ErrorDetails) {
+		scheme := "http"
+		if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+			scheme = "https"
+		}
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		// Overlord only takes domain names, so requests to an IP address
+		// keep the client's domain
+		ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+		if host != "" && ip == nil {
+			data.Domain = host
+		}
+		data.URL = scheme + "://" + r.Host + r.URL.RequestURI()
+		data.UserAgent = r.UserAgent()
+		WithTags(map[string]string{"http.method": r.Method})(data)
+	}
+}
+
+// CaptureError reports an error from where it is called.
+func (c *Client) CaptureError(err error, options ...Option) bool {
+	if err == nil {
+		return false
+	}
+	data := types.ErrorDetails{ErrorText: err.Error()}
+	WithTags(map[string]string{"error.type": fmt.Sprintf("%T", err)})(&data)
+	return c.capture(data, 2, options)
+}
+
+// CaptureMessage reports a message from where it is called.
+func (c *Client) CaptureMessage(message string, options ...Option) bool {
+	return c.capture(types.ErrorDetails{ErrorText: message}, 2, options)
+}
+
+// capture records the stack and sends the event. skip is how many of the
+// innermost frames, starting with capture itself, are left out.
+func (c *Client) capture(data types.ErrorDetails, skip int, options []Option) bool {
+	if data.StackTrace == "" {
+		data.StackTrace, data.Filename, data.Line = stack(skip)
+	}
+	for _, option := range options {
+		option(&data)
+	}
+	return c.Send(data)
+}
+
+// stack formats the calling goroutine's stack like a Go traceback, leaving
+// out the skip innermost frames of its caller, and returns the location of
+// the innermost frame left.
+func stack(skip int) (trace, file string, line int) {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip+2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var b strings.Builder
+	for {
+		frame, more := frames.Next()
+		if file == "" {
+			file, line = frame.File, frame.Line
+		}
+		fmt.Fprintf(&b, "%s(...)\n\t%s:%d +0x%x\n", frame.Function, frame.File, frame.Line, frame.PC-frame.Entry)
+		if !more {
+			break
+		}
+	}
+	return b.String(), file, line
+}
@@ -0,0 +1,335 @@
+package reporter
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tjseabury/overlord/types"
+)
+
+// collector is a fake Overlord server that records the events it receives.
+type collector struct {
+	mu       sync.Mutex
+	events   []types.ErrorDetails
+	requests int
+	// Statuses to respond with before accepting requests
+	failures []int
+	// The Retry-After header sent with failures
+	retryAfter string
+	// Errors to reject events with, by their error text
+	rejections map[string]types.ValidationErrors
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+
+	if r.URL.Path != "/api/report-error/batch" || r.Header.Get("X-ACCESS-TOKEN") != "token" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if len(c.failures) > 0 {
+		status := c.failures[0]
+		c.failures = c.failures[1:]
+		if c.retryAfter != "" {
+			w.Header().Set("Retry-After", c.retryAfter)
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		http.Error(w, "Expected gzip", http.StatusBadRequest)
+		return
+	}
+	var batch []types.ErrorDetails
+	if err := json.NewDecoder(gz).Decode(&batch); err != nil {
+		http.Error(w, "Invalid batch", http.StatusBadRequest)
+		return
+	}
+	result := types.BatchResult{Results: make([]types.BatchItemResult, len(batch))}
+	for i, data := range batch {
+		result.Results[i] = types.BatchItemResult{Index: i, Errors: c.rejections[data.ErrorText]}
+		if result.Results[i].Errors != nil {
+			result.Rejected++
+			continue
+		}
+		result.Results[i].Accepted = true
+		result.Accepted++
+		c.events = append(c.events, data)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func newTestClient(t *testing.T, c *collector, config Config) (*Client, *httptest.Server) {
+	t.Helper()
+	server := httptest.NewServer(c)
+	t.Cleanup(server.Close)
+
+	config.Endpoint = server.URL
+	config.Token = "token"
+	config.FlushInterval = 10 * time.Millisecond
+	config.RetryBackoff = time.Millisecond
+	client, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(func() { client.Close(context.Background()) })
+	return client, server
+}
+
+func flush(t *testing.T, client *Client) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Flush(ctx); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, config := range []Config{
+		{Endpoint: "https://overlord.example.com"},
+		{Endpoint: "overlord.example.com", Token: "token"},
+		{Token: "token"},
+	} {
+		if _, err := New(config); err == nil {
+			t.Errorf("New(%+v) expected an error", config)
+		}
+	}
+}
+
+func TestCaptureError(t *testing.T) {
+	c := &collector{}
+	client, _ := newTestClient(t, c, Config{
+		Domain:      "api.example.com",
+		Release:     "1.0.0",
+		Environment: "production",
+		Tags:        map[string]string{"service": "billing"},
+		BatchSize:   2,
+	})
+
+	err := &fs.PathError{Op: "open", Path: "config.yaml", Err: fs.ErrNotExist}
+	_, _, line, _ := runtime.Caller(0)
+	client.CaptureError(err, WithTags(map[string]string{"tenant": "acme"}), WithExtra(map[string]any{"attempt": 2}))
+	client.CaptureMessage("cache is cold")
+	client.CaptureError(nil)
+	flush(t, client)
+
+	if len(c.events) != 2 {
+		t.Fatalf("Expected 2 events; got %d", len(c.events))
+	}
+	event := c.events[0]
+	if event.ErrorText != "open config.yaml: file does not exist" || event.Domain != "api.example.com" || event.URL != "https://api.example.com/" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	if !strings.HasSuffix(event.Filename, "reporter_test.go") || event.Line != line+1 || event.Column != 1 {
+		t.Errorf("Expected the event at reporter_test.go:%d; got %s:%d:%d", line+1, event.Filename, event.Line, event.Column)
+	}
+	if !strings.Contains(event.StackTrace, "reporter.TestCaptureError(...)\n\t") || strings.Contains(event.StackTrace, "reporter.(*Client)") {
+		t.Errorf("Expected the stack to start at the caller; got %s", event.StackTrace)
+	}
+	if event.Release != "1.0.0" || event.Environment != "production" || event.Tags["service"] != "billing" || event.Tags["tenant"] != "acme" || event.Tags["error.type"] != "*fs.PathError" {
+		t.Errorf("Expected the client's and the event's context; got %+v", event)
+	}
+	if event.Extra["attempt"] != float64(2) || !strings.HasPrefix(event.UserAgent, "overlord-go/") {
+		t.Errorf("Expected extra context and the SDK user agent; got %+v", event)
+	}
+	if c.events[1].ErrorText != "cache is cold" {
+		t.Errorf("Expected the message; got %+v", c.events[1])
+	}
+}
+
+func TestRetry(t *testing.T) {
+	c := &collector{failures: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	client, _ := newTestClient(t, c, Config{Domain: "api.example.com"})
+
+	client.CaptureMessage("retried")
+	flush(t, client)
+	if len(c.events) != 1 || c.requests != 3 {
+		t.Errorf("Expected the event after 2 retries; got %d events in %d requests", len(c.events), c.requests)
+	}
+
+	// Rejected batches are not retried
+	var reported error
+	c = &collector{failures: []int{http.StatusUnprocessableEntity}}
+	client, _ = newTestClient(t, c, Config{Domain: "api.example.com", OnError: func(err error) { reported = err }})
+	client.CaptureMessage("rejected")
+	flush(t, client)
+	if c.requests != 1 || client.Stats().Failed != 1 || reported == nil {
+		t.Errorf("Expected one failed request; got %d requests, %+v, %v", c.requests, client.Stats(), reported)
+	}
+}
+
+func TestRejectedEvents(t *testing.T) {
+	c := &collector{rejections: map[string]types.ValidationErrors{
+		"too many tags": {{Field: "tags", Code: "tags.too_many", Message: "Too many tags"}},
+	}}
+	var mu sync.Mutex
+	var rejected []*RejectedError
+	client, _ := newTestClient(t, c, Config{Domain: "api.example.com", BatchSize: 2, OnError: func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if rejection, ok := err.(*RejectedError); ok {
+			rejected = append(rejected, rejection)
+		}
+	}})
+
+	client.CaptureMessage("too many tags")
+	client.CaptureMessage("accepted")
+	flush(t, client)
+
+	if stats := client.Stats(); stats.Sent != 1 || stats.Failed != 1 {
+		t.Errorf("Expected 1 event sent and 1 failed; got %+v", stats)
+	}
+	if len(rejected) != 1 || rejected[0].Event.ErrorText != "too many tags" || rejected[0].Errors[0].Code != "tags.too_many" {
+		t.Errorf("Expected the rejected event with its errors; got %+v", rejected)
+	}
+}
+
+func TestWithRequest(t *testing.T) {
+	c := &collector{}
+	client, _ := newTestClient(t, c, Config{Domain: "api.example.com"})
+
+	// IP addresses are not domains, so those requests keep the client's
+	hosts := map[string]string{
+		"shop.example.com":      "shop.example.com",
+		"shop.example.com:8080": "shop.example.com",
+		"[::1]:8080":            "api.example.com",
+		"[::1]":                 "api.example.com",
+		"127.0.0.1:8080":        "api.example.com",
+	}
+	for host := range hosts {
+		req := httptest.NewRequest("GET", "/checkout", nil)
+		req.Host = host
+		client.CaptureMessage(host, WithRequest(req))
+	}
+	flush(t, client)
+
+	if len(c.events) != len(hosts) {
+		t.Fatalf("Expected %d events; got %d", len(hosts), len(c.events))
+	}
+	for _, event := range c.events {
+		host := event.ErrorText
+		if event.Domain != hosts[host] || event.URL != "http://"+host+"/checkout" {
+			t.Errorf("WithRequest(%q) = %q, %q; want %q", host, event.Domain, event.URL, hosts[host])
+		}
+	}
+}
+
+func TestRetryAfterTooLong(t *testing.T) {
+	// An exhausted daily quota asks to wait until midnight
+	c := &collector{failures: []int{http.StatusTooManyRequests}, retryAfter: "86400"}
+	var reported error
+	client, _ := newTestClient(t, c, Config{Domain: "api.example.com", OnError: func(err error) { reported = err }})
+
+	start := time.Now()
+	client.CaptureMessage("over quota")
+	flush(t, client)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the batch to be given up on; waited %v", elapsed)
+	}
+	if c.requests != 1 || client.Stats().Failed != 1 || reported == nil {
+		t.Errorf("Expected one failed request; got %d requests, %+v, %v", c.requests, client.Stats(), reported)
+	}
+}
+
+func TestSendAfterClose(t *testing.T) {
+	client, _ := newTestClient(t, &collector{}, Config{Domain: "api.example.com"})
+	client.Close(context.Background())
+	if client.CaptureMessage("too late") || client.Stats().Dropped != 1 {
+		t.Errorf("Expected events sent after Close to be dropped; got %+v", client.Stats())
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	c := &collector{}
+	client, _ := newTestClient(t, c, Config{Domain: "api.example.com"})
+
+	handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/abort" {
+			panic(http.ErrAbortHandler)
+		}
+		var prices map[string]int
+		prices["coffee"] = 3
+	}))
+
+	req := httptest.NewRequest("POST", "https://shop.example.com/checkout?step=2", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500; got %d", rec.Code)
+	}
+
+	func() {
+		defer func() {
+			if value := recover(); value != http.ErrAbortHandler {
+				t.Errorf("Expected http.ErrAbortHandler to be passed on; got %v", value)
+			}
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/abort", nil))
+	}()
+	flush(t, client)
+
+	if len(c.events) != 1 {
+		t.Fatalf("Expected 1 event; got %d", len(c.events))
+	}
+	event := c.events[0]
+	if event.ErrorText != "panic: assignment to entry in nil map" || event.URL != "https://shop.example.com/checkout?step=2" || event.Domain != "shop.example.com" || event.UserAgent != "Mozilla/5.0" {
+		t.Errorf("Expected the panic with its request; got %+v", event)
+	}
+	if !strings.HasSuffix(event.Filename, "reporter_test.go") || !strings.HasPrefix(event.StackTrace, "goroutine ") || event.Tags["http.method"] != "POST" {
+		t.Errorf("Expected the panic's location and stack; got %s:%d %v\n%s", event.Filename, event.Line, event.Tags, event.StackTrace)
+	}
+	if event.Tags["panic.type"] == "" {
+		t.Errorf("Expected the panic type; got %v", event.Tags)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	c := &collector{}
+	client, _ := newTestClient(t, c, Config{Domain: "api.example.com"})
+
+	var output strings.Builder
+	handler := NewHandler(slog.NewTextHandler(&output, &slog.HandlerOptions{Level: slog.LevelInfo}), client, &HandlerOptions{Level: slog.LevelWarn})
+	logger := slog.New(handler).With("service", "billing").WithGroup("payment")
+
+	logger.Info("payment started", "provider", "acme")
+	_, _, line, _ := runtime.Caller(0)
+	logger.Error("payment failed", "provider", "acme", "err", fs.ErrNotExist, slog.Group("card", "brand", "visa"), "receipt", strings.Repeat("x", 300))
+	logger.Debug("not logged anywhere")
+	flush(t, client)
+
+	if strings.Count(output.String(), "\n") != 2 {
+		t.Errorf("Expected both info and error records to be logged; got %q", output.String())
+	}
+	if len(c.events) != 1 {
+		t.Fatalf("Expected 1 event; got %d", len(c.events))
+	}
+	event := c.events[0]
+	if event.ErrorText != "payment failed: file does not exist" || !strings.HasSuffix(event.Filename, "reporter_test.go") || event.Line != line+1 {
+		t.Errorf("Expected the error at reporter_test.go:%d; got %q at %s:%d", line+1, event.ErrorText, event.Filename, event.Line)
+	}
+	tags := map[string]string{"level": "ERROR", "service": "billing", "payment.provider": "acme", "payment.card.brand": "visa", "error.type": "*errors.errorString"}
+	for key, value := range tags {
+		if event.Tags[key] != value {
+			t.Errorf("Expected tag %s=%s; got %v", key, value, event.Tags)
+		}
+	}
+	if _, ok := event.Tags["payment.receipt"]; ok || event.Extra["payment.receipt"] != strings.Repeat("x", 300) {
+		t.Errorf("Expected long values as extra context; got %v %v", event.Tags, event.Extra)
+	}
+}
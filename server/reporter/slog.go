@@ -0,0 +1,169 @@
+package reporter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"runtime"
+	"slices"
+	"time"
+
+	"tjseabury/overlord/types"
+)
+
+// The default tag limits of an Overlord server. Attributes that do not fit
+// in a tag are sent as extra context instead, as the server rejects events
+// with tags over its limits.
+const (
+	maxTags           = 50
+	maxTagKeyLength   = 32
+	maxTagValueLength = 200
+)
+
+var tagKeyRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// HandlerOptions configures a Handler.
+type HandlerOptions struct {
+	// The lowest level of records reported to Overlord; defaults to
+	// slog.LevelError
+	Level slog.Leveler
+}
+
+// Handler is a slog.Handler that passes every record on to another handler
+// and also reports records at or above a level to Overlord. Attributes
+// become tags, with the keys of groups joined by dots.
+//
+//	logger := slog.New(reporter.NewHandler(slog.NewJSONHandler(os.Stderr, nil), client, nil))
+//	logger.Error("payment failed", "provider", "acme", "err", err)
+//
+// Events are sent through the client's queue, so logging never waits on
+// Overlord.
+type Handler struct {
+	next   slog.Handler
+	client *Client
+	level  slog.Leveler
+	// Attributes added with WithAttrs, with their keys already qualified
+	attrs []slog.Attr
+	// The group prefix of attributes added from now on
+	prefix string
+}
+
+// NewHandler wraps next in a Handler reporting to client.
+func NewHandler(next slog.Handler, client *Client, options *HandlerOptions) *Handler {
+	h := &Handler{next: next, client: client, level: slog.LevelError}
+	if options != nil && options.Level != nil {
+		h.level = options.Level
+	}
+	return h
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() || h.next.Enabled(ctx, level)
+}
+
+// Handle reports the record if it is at or above the handler's level, and
+// passes it on if the wrapped handler is enabled for it.
+func (h *Handler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= h.level.Level() {
+		h.client.Send(h.event(record))
+	}
+	if !h.next.Enabled(ctx, record.Level) {
+		return nil
+	}
+	return h.next.Handle(ctx, record)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	h2 := *h
+	h2.next = h.next.WithAttrs(attrs)
+	h2.attrs = make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	h2.attrs = append(h2.attrs, h.attrs...)
+	for _, attr := range attrs {
+		h2.attrs = appendAttr(h2.attrs, h.prefix, attr)
+	}
+	return &h2
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.next = h.next.WithGroup(name)
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
+
+// appendAttr appends an attribute, or the attributes of a group, with its
+// key qualified by prefix.
+func appendAttr(attrs []slog.Attr, prefix string, attr slog.Attr) []slog.Attr {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return attrs
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			prefix += attr.Key + "."
+		}
+		for _, member := range attr.Value.Group() {
+			attrs = appendAttr(attrs, prefix, member)
+		}
+		return attrs
+	}
+	attr.Key = prefix + attr.Key
+	return append(attrs, attr)
+}
+
+// event maps a record onto an Overlord payload. The message is the error
+// text; if an attribute is an error, its text is added, like fmt.Errorf
+// would.
+func (h *Handler) event(record slog.Record) types.ErrorDetails {
+	// Clipped so that records never append into the handler's attributes
+	attrs := slices.Clip(h.attrs)
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs = appendAttr(attrs, h.prefix, attr)
+		return true
+	})
+
+	data := types.ErrorDetails{
+		ErrorText: record.Message,
+		Tags:      map[string]string{"level": record.Level.String(), "logger": "slog"},
+	}
+	if !record.Time.IsZero() {
+		data.Datetime = record.Time.UTC().Format(time.RFC3339)
+	}
+	if record.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{record.PC}).Next()
+		data.Filename, data.Line = frame.File, frame.Line
+		data.StackTrace = fmt.Sprintf("%s(...)\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+	}
+
+	reported := false
+	for _, attr := range attrs {
+		if err, ok := attr.Value.Any().(error); ok && !reported {
+			data.ErrorText += ": " + err.Error()
+			data.Tags["error.type"] = fmt.Sprintf("%T", err)
+			reported = true
+			continue
+		}
+		value := attr.Value.String()
+		if len(data.Tags) < maxTags && len(attr.Key) <= maxTagKeyLength && len(value) <= maxTagValueLength && tagKeyRegex.MatchString(attr.Key) {
+			data.Tags[attr.Key] = value
+			continue
+		}
+		if data.Extra == nil {
+			data.Extra = make(map[string]any)
+		}
+		// Arbitrary values may not encode as JSON
+		if attr.Value.Kind() == slog.KindAny {
+			data.Extra[attr.Key] = value
+		} else {
+			data.Extra[attr.Key] = attr.Value.Any()
+		}
+	}
+	return data
+}
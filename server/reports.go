@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"tjseabury/overlord/types"
+)
+
+// Browsers deliver Reporting API reports to the endpoints a page names in
+// its response headers. They cannot add the ingestion token as a header, so
+// it goes in the path:
+//
+//	Reporting-Endpoints: overlord="https://<overlord host>/api/reports/<token>"
+//	Report-To: {"group":"overlord","max_age":86400,"endpoints":[{"url":"https://<overlord host>/api/reports/<token>"}]}
+
+// browserReport is a single report of an application/reports+json batch.
+type browserReport struct {
+	Type      string         `json:"type"`
+	Age       int64          `json:"age"`
+	URL       string         `json:"url"`
+	UserAgent string         `json:"user_agent"`
+	Body      map[string]any `json:"body"`
+}
+
+func (r *browserReport) text(key string) string {
+	if value, ok := r.Body[key].(string); ok {
+		return value
+	}
+	return ""
+}
+
+func (r *browserReport) number(key string) int {
+	if value, ok := r.Body[key].(float64); ok {
+		return int(value)
+	}
+	return 0
+}
+
+// reportErrorDetails maps a report onto an Overlord payload of the
+// matching event type. It returns false for report types Overlord does not
+// store.
+func reportErrorDetails(report *browserReport, received time.Time, userAgent string) (types.ErrorDetails, bool) {
+	data := types.ErrorDetails{
+		URL:       report.URL,
+		UserAgent: cmp.Or(report.UserAgent, userAgent),
+		Datetime:  received.Add(-time.Duration(report.Age) * time.Millisecond).UTC().Format(time.RFC3339),
+		Filename:  report.text("sourceFile"),
+		Line:      report.number("lineNumber"),
+		Column:    report.number("columnNumber"),
+		Extra:     report.Body,
+		Tags:      make(map[string]string),
+	}
+
+	switch report.Type {
+	case types.EventTypeDeprecation, types.EventTypeIntervention:
+		data.ErrorText = cmp.Or(report.text("message"), report.text("id"))
+		if id := report.text("id"); id != "" {
+			data.Tags["report.id"] = id
+		}
+	case types.EventTypeCrash:
+		data.ErrorText = "Page crashed"
+		if reason := report.text("reason"); reason != "" {
+			data.ErrorText += ": " + reason
+			data.Tags["crash.reason"] = reason
+		}
+	case types.EventTypeCSPViolation:
+		violation := normalizeCSPViolation(report)
+		data.URL = cmp.Or(violation.DocumentURL, report.URL)
+		data.ErrorText = fmt.Sprintf("%s blocked %s", violation.Directive, violation.Blocked)
+		data.Tags["csp.directive"] = violation.Directive
+		data.Tags["csp.blocked"] = violation.Blocked
+		if violation.Disposition != "" {
+			data.Tags["csp.disposition"] = violation.Disposition
+		}
+	default:
+		return data, false
+	}
+	data.Type = report.Type
+
+	// Reports about the page itself have no script location
+	if u, err := url.Parse(data.URL); err == nil {
+		data.Domain = u.Hostname()
+	}
+	data.Filename = cmp.Or(data.Filename, data.URL)
+	data.Line = max(data.Line, 1)
+	data.Column = max(data.Column, 1)
+	return data, true
+}
+
+// decodeReports reads an application/reports+json body, which is a list of
+// reports, or a single report. An application/csp-report body is turned
+// into a Reporting API report.
+func decodeReports(body []byte) ([]browserReport, error) {
+	reports := make([]browserReport, 0)
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		var report browserReport
+		if err := json.Unmarshal(trimmed, &report); err != nil {
+			return nil, err
+		}
+		var legacy struct {
+			Report map[string]any `json:"csp-report"`
+		}
+		if json.Unmarshal(trimmed, &legacy) == nil && legacy.Report != nil {
+			report = cspReport(legacy.Report)
+		}
+		return append(reports, report), nil
+	}
+	if err := json.Unmarshal(body, &reports); err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+func (router *Router) api_reports(w http.ResponseWriter, r *http.Request) {
+	property, ok := router.admitToken(w, r, r.PathValue("token"))
+	if !ok {
+		return
+	}
+
+	body, err := readBody(w, r, router.Limits.MaxBatchBodyBytes)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	reports, err := decodeReports(body)
+	if err != nil {
+		http.Error(w, "Error parsing reports", http.StatusBadRequest)
+		return
+	}
+	if len(reports) > maxBatchItems {
+		http.Error(w, "Batch is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	received := time.Now()
+	result := types.BatchResult{Results: make([]types.BatchItemResult, len(reports))}
+	payloads := make([]*types.ErrorDetails, len(reports))
+	network := make([]NetworkReport, 0)
+	networkIndexes := make([]int, 0)
+	invalid := 0
+	for i := range reports {
+		// Network errors are not events, as browsers also report requests
+		// that succeeded
+		if reports[i].Type == reportTypeNetworkError {
+			report, errs := newNetworkReport(&property, &reports[i], received)
+			if len(errs) > 0 {
+				result.Results[i].Errors = errs
+				invalid++
+				continue
+			}
+			network = append(network, report)
+			networkIndexes = append(networkIndexes, i)
+			continue
+		}
+
+		data, ok := reportErrorDetails(&reports[i], received, r.UserAgent())
+		if !ok {
+			result.Results[i].Errors = types.ValidationErrors{{
+				Field:   "type",
+				Code:    "report.unsupported",
+				Message: fmt.Sprintf("Reports of type %q are not supported", reports[i].Type),
+			}}
+			invalid++
+			continue
+		}
+		payloads[i] = &data
+	}
+	recordOutcome(router.DB, property.ID, OutcomeInvalid, invalid)
+
+	// Network reports count against the daily quota like events do
+	reserved := router.Quotas.Reserve(&property, len(network))
+	if reserved < len(network) {
+		if reserved == 0 {
+			recordOutcome(router.DB, property.ID, OutcomeQuotaExceeded, len(network))
+			writeTooManyRequests(w, untilTomorrow(), "Daily quota exceeded")
+			return
+		}
+		for _, i := range networkIndexes[reserved:] {
+			result.Results[i].Errors = types.ValidationErrors{{
+				Code:    "quota.exceeded",
+				Message: "Daily quota exceeded",
+			}}
+		}
+		recordOutcome(router.DB, property.ID, OutcomeQuotaExceeded, len(network)-reserved)
+		network = network[:reserved]
+		networkIndexes = networkIndexes[:reserved]
+	}
+	for _, i := range networkIndexes {
+		result.Results[i].Accepted = true
+	}
+
+	// Nothing is stored unless the batch is accepted, so a browser retrying
+	// a refused batch does not duplicate its network reports
+	if !router.acceptEvents(w, &property, payloads, &result) {
+		router.Quotas.Release(property.ID, len(network))
+		return
+	}
+
+	if len(network) > 0 {
+		if err := storeNetworkReports(router.DB, network); err != nil {
+			// The batch's events are already queued, so the reports are
+			// rejected rather than the whole batch retried
+			log.Printf("Error storing %d network reports: %v", len(network), err)
+			router.Quotas.Release(property.ID, len(network))
+			for _, i := range networkIndexes {
+				result.Results[i].Accepted = false
+				result.Results[i].Errors = types.ValidationErrors{{
+					Code:    "storage.failed",
+					Message: "Network report could not be stored",
+				}}
+			}
+			result.Accepted -= len(network)
+			result.Rejected += len(network)
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
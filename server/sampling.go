@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"strings"
+	"sync"
+
+	"tjseabury/overlord/types"
+)
+
+// OutcomeSampled counts events dropped by sampling
+const OutcomeSampled = "sampled"
+
+// SamplingRule overrides the sample rate of a property for the events it
+// matches. An empty pattern or environment matches every event.
+type SamplingRule struct {
+	// A regular expression matched against the error text
+	ErrorPattern string `json:"errorPattern,omitempty"`
+	// Only match events reported from this environment
+	Environment string `json:"environment,omitempty"`
+	// The fraction of matching events to keep, from 0 to 1
+	SampleRate float64 `json:"sampleRate"`
+}
+
+// Regular expressions from property settings, compiled once
+var patternCache sync.Map
+
+// compilePattern compiles a regular expression, reusing earlier results.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := patternCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patternCache.Store(pattern, re)
+	return re, nil
+}
+
+func (rule *SamplingRule) matches(data *types.ErrorDetails) bool {
+	if rule.Environment != "" && !strings.EqualFold(rule.Environment, data.Environment) {
+		return false
+	}
+	if rule.ErrorPattern != "" {
+		re, err := compilePattern(rule.ErrorPattern)
+		if err != nil || !re.MatchString(data.ErrorText) {
+			return false
+		}
+	}
+	return true
+}
+
+// SampleRateFor returns the fraction of events like data that the property
+// keeps: the rate of the first matching rule, or else the property's own.
+func (p *WebProperty) SampleRateFor(data *types.ErrorDetails) float64 {
+	for i := range p.SamplingRules {
+		if p.SamplingRules[i].matches(data) {
+			return p.SamplingRules[i].SampleRate
+		}
+	}
+	if p.SampleRate <= 0 {
+		return 1
+	}
+	return p.SampleRate
+}
+
+// validateSampling checks sampling settings before they are saved.
+func validateSampling(rate *float64, rules []SamplingRule) error {
+	if rate != nil && (*rate <= 0 || *rate > 1) {
+		return errors.New("sampleRate must be greater than 0 and at most 1")
+	}
+	for i, rule := range rules {
+		if rule.SampleRate < 0 || rule.SampleRate > 1 {
+			return fmt.Errorf("samplingRules[%d].sampleRate must be between 0 and 1", i)
+		}
+		if _, err := regexp.Compile(rule.ErrorPattern); err != nil {
+			return fmt.Errorf("samplingRules[%d].errorPattern is invalid: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// sampleEvent decides whether to keep an event, stamping it with the sample
+// rate that was applied.
+func sampleEvent(property *WebProperty, event *IngestedEvent) bool {
+	rate := property.SampleRateFor(&event.ErrorDetails)
+	event.SampleRate = rate
+	return rate >= 1 || rand.Float64() < rate
+}
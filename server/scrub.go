@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"tjseabury/overlord/types"
+)
+
+// What scrubbed values are replaced with
+const scrubbedValue = "[Filtered]"
+
+// The names of the built-in scrubbing rules. Custom rules are recorded as
+// "custom:<name>".
+const (
+	ScrubQueryParam  = "query-param"
+	ScrubBearerToken = "bearer-token"
+	ScrubJWT         = "jwt"
+	ScrubEmail       = "email"
+	ScrubCreditCard  = "credit-card"
+)
+
+// Query parameters whose values are always scrubbed
+var defaultScrubbedParams = []string{
+	"access_token", "api_key", "apikey", "auth", "code", "email", "id_token",
+	"key", "passwd", "password", "refresh_token", "secret", "session",
+	"sessionid", "token",
+}
+
+var (
+	bearerRegex     = regexp.MustCompile(`(?i)\b(bearer\s+)[A-Za-z0-9\-._~+/]+=*`)
+	jwtRegex        = regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	emailRegex      = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)
+	creditCardRegex = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+)
+
+// ScrubRule masks every match of a regular expression.
+type ScrubRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+}
+
+// ScrubSettings are a property's additions to the built-in scrubbing rules,
+// which always mask emails, credit card numbers, bearer tokens, JWTs and
+// the values of common secret query parameters.
+type ScrubSettings struct {
+	QueryParams []string    `json:"queryParams"`
+	Rules       []ScrubRule `json:"rules"`
+}
+
+// queryParamRegex matches the values of the scrubbed query parameters,
+// keeping the parameter names. Parameters in the fragment count too, as
+// OAuth's implicit flow returns tokens there.
+func (s *ScrubSettings) queryParamRegex() *regexp.Regexp {
+	names := slices.Clone(defaultScrubbedParams)
+	for _, name := range s.QueryParams {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, regexp.QuoteMeta(name))
+		}
+	}
+	re, err := compilePattern(`(?i)([?&;#](?:` + strings.Join(names, "|") + `)=)[^&#\s"'<>)]*`)
+	if err != nil {
+		return nil
+	}
+	return re
+}
+
+// luhnValid reports whether the digits of s pass the Luhn checksum, which
+// keeps long IDs and timestamps from being mistaken for card numbers.
+func luhnValid(s string) bool {
+	sum, double, digits := 0, false, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+		digits++
+	}
+	return digits >= 13 && sum%10 == 0
+}
+
+// scrubText masks everything the rules match in s, adding the names of the
+// rules that fired to fired.
+func (s *ScrubSettings) scrubText(text string, fired map[string]bool) string {
+	if text == "" {
+		return text
+	}
+	replace := func(name string, re *regexp.Regexp, repl func(string) string) {
+		text = re.ReplaceAllStringFunc(text, func(match string) string {
+			masked := repl(match)
+			if masked != match {
+				fired[name] = true
+			}
+			return masked
+		})
+	}
+	// Replace a match's value, keeping the prefix captured by group 1
+	keepPrefix := func(re *regexp.Regexp) func(string) string {
+		return func(match string) string {
+			return re.FindStringSubmatch(match)[1] + scrubbedValue
+		}
+	}
+	mask := func(string) string { return scrubbedValue }
+
+	if re := s.queryParamRegex(); re != nil {
+		replace(ScrubQueryParam, re, keepPrefix(re))
+	}
+	replace(ScrubBearerToken, bearerRegex, keepPrefix(bearerRegex))
+	replace(ScrubJWT, jwtRegex, mask)
+	replace(ScrubEmail, emailRegex, mask)
+	replace(ScrubCreditCard, creditCardRegex, func(match string) string {
+		if luhnValid(match) {
+			return scrubbedValue
+		}
+		return match
+	})
+	for _, rule := range s.Rules {
+		if re, err := compilePattern(rule.Pattern); err == nil {
+			replace("custom:"+rule.Name, re, mask)
+		}
+	}
+	return text
+}
+
+// scrubValue scrubs the strings in a decoded JSON value.
+func (s *ScrubSettings) scrubValue(value any, fired map[string]bool) any {
+	switch v := value.(type) {
+	case string:
+		return s.scrubText(v, fired)
+	case []any:
+		for i := range v {
+			v[i] = s.scrubValue(v[i], fired)
+		}
+	case map[string]any:
+		for key := range v {
+			v[key] = s.scrubValue(v[key], fired)
+		}
+	}
+	return value
+}
+
+// Scrub masks personal data in the free-form fields of a payload and
+// returns the names of the rules that fired, sorted. Tags whose key holds
+// personal data are dropped, as a masked key is not a valid tag key.
+func (s *ScrubSettings) Scrub(data *types.ErrorDetails) []string {
+	fired := make(map[string]bool)
+	data.URL = s.scrubText(data.URL, fired)
+	data.Filename = s.scrubText(data.Filename, fired)
+	data.ErrorText = s.scrubText(data.ErrorText, fired)
+	data.StackTrace = s.scrubText(data.StackTrace, fired)
+	data.Release = s.scrubText(data.Release, fired)
+	data.Environment = s.scrubText(data.Environment, fired)
+	for key, value := range data.Tags {
+		if s.scrubText(key, fired) != key {
+			delete(data.Tags, key)
+			continue
+		}
+		data.Tags[key] = s.scrubText(value, fired)
+	}
+	for key, value := range data.Extra {
+		data.Extra[key] = s.scrubValue(value, fired)
+	}
+	for i := range data.Breadcrumbs {
+		data.Breadcrumbs[i].Message = s.scrubText(data.Breadcrumbs[i].Message, fired)
+		for key, value := range data.Breadcrumbs[i].Data {
+			data.Breadcrumbs[i].Data[key] = s.scrubValue(value, fired)
+		}
+	}
+
+	rules := make([]string, 0, len(fired))
+	for name := range fired {
+		rules = append(rules, name)
+	}
+	slices.Sort(rules)
+	return rules
+}
+
+// validateScrubbing checks scrubbing settings before they are saved.
+func validateScrubbing(s *ScrubSettings) error {
+	if s == nil {
+		return nil
+	}
+	for i, rule := range s.Rules {
+		if strings.TrimSpace(rule.Name) == "" {
+			return errors.New("scrubbing rules need a name")
+		}
+		if rule.Pattern == "" {
+			return fmt.Errorf("rules[%d].pattern is required", i)
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("rules[%d].pattern is invalid: %v", i, err)
+		}
+		if re.MatchString("") {
+			return fmt.Errorf("rules[%d].pattern must not match empty text", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"tjseabury/overlord/types"
+)
+
+// Sentry SDKs are pointed at Overlord with a DSN of the form
+//
+//	https://<ingestion token>@<overlord host>/<web property id>
+//
+// and send events to the store and envelope endpoints of that project.
+
+// sentryEvent is the part of a Sentry event payload that Overlord keeps.
+// Fields that SDKs send in more than one shape are decoded by hand.
+type sentryEvent struct {
+	EventID     string                          `json:"event_id"`
+	Timestamp   json.RawMessage                 `json:"timestamp"`
+	Platform    string                          `json:"platform"`
+	Level       string                          `json:"level"`
+	Logger      string                          `json:"logger"`
+	ServerName  string                          `json:"server_name"`
+	Release     string                          `json:"release"`
+	Environment string                          `json:"environment"`
+	Message     json.RawMessage                 `json:"message"`
+	LogEntry    *sentryLogEntry                 `json:"logentry"`
+	Exception   json.RawMessage                 `json:"exception"`
+	Stacktrace  *sentryStacktrace               `json:"stacktrace"`
+	Tags        json.RawMessage                 `json:"tags"`
+	Extra       map[string]any                  `json:"extra"`
+	User        map[string]any                  `json:"user"`
+	Request     *sentryRequest                  `json:"request"`
+	Breadcrumbs json.RawMessage                 `json:"breadcrumbs"`
+	SDK         *struct{ Name, Version string } `json:"sdk"`
+}
+
+type sentryLogEntry struct {
+	Message   string `json:"message"`
+	Formatted string `json:"formatted"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *sentryStacktrace `json:"stacktrace"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"`
+}
+
+// sentryFrame is a frame of a Sentry stack trace. Sentry lists frames
+// outermost first, the reverse of Overlord.
+type sentryFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module"`
+	Filename string `json:"filename"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	Colno    int    `json:"colno"`
+	InApp    *bool  `json:"in_app"`
+}
+
+func (f sentryFrame) file() string {
+	switch {
+	case f.AbsPath != "":
+		return f.AbsPath
+	case f.Filename != "":
+		return f.Filename
+	}
+	return f.Module
+}
+
+type sentryRequest struct {
+	URL     string          `json:"url"`
+	Headers json.RawMessage `json:"headers"`
+}
+
+type sentryBreadcrumb struct {
+	Timestamp json.RawMessage `json:"timestamp"`
+	Type      string          `json:"type"`
+	Category  string          `json:"category"`
+	Message   string          `json:"message"`
+	Level     string          `json:"level"`
+	Data      map[string]any  `json:"data"`
+}
+
+// sentryPairs decodes a field sent either as an object or as a list of
+// [key, value] pairs, such as tags and request headers.
+func sentryPairs(raw json.RawMessage) map[string]string {
+	pairs := make(map[string]string)
+	if len(raw) == 0 {
+		return pairs
+	}
+	var object map[string]any
+	if json.Unmarshal(raw, &object) == nil {
+		for key, value := range object {
+			if value != nil {
+				pairs[key] = fmt.Sprint(value)
+			}
+		}
+		return pairs
+	}
+	var list [][]any
+	if json.Unmarshal(raw, &list) == nil {
+		for _, pair := range list {
+			if len(pair) == 2 && pair[1] != nil {
+				pairs[fmt.Sprint(pair[0])] = fmt.Sprint(pair[1])
+			}
+		}
+	}
+	return pairs
+}
+
+// sentryValues decodes a field sent either as {"values": [...]} or as the
+// bare list, such as exceptions and breadcrumbs.
+func sentryValues[T any](raw json.RawMessage) []T {
+	var values []T
+	if len(raw) == 0 {
+		return values
+	}
+	var wrapped struct {
+		Values []T `json:"values"`
+	}
+	if json.Unmarshal(raw, &wrapped) == nil && wrapped.Values != nil {
+		return wrapped.Values
+	}
+	json.Unmarshal(raw, &values)
+	return values
+}
+
+// sentryTime decodes a timestamp sent as seconds since the epoch or as an
+// RFC 3339 string, which may lack a time zone.
+func sentryTime(raw json.RawMessage) (time.Time, bool) {
+	var seconds float64
+	if json.Unmarshal(raw, &seconds) == nil && seconds > 0 {
+		whole, frac := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(frac*1e9)).UTC(), true
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"} {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t.UTC(), true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// renderSentryStack writes Sentry frames out as a V8 stack trace, innermost
+// first, so they are parsed like any other stack.
+func renderSentryStack(heading string, frames []sentryFrame) string {
+	var b strings.Builder
+	b.WriteString(heading)
+	for i := len(frames) - 1; i >= 0; i-- {
+		frame := frames[i]
+		location := frame.file()
+		if location == "" {
+			location = "<anonymous>"
+		}
+		if frame.Lineno > 0 {
+			location += ":" + strconv.Itoa(frame.Lineno)
+			if frame.Colno > 0 {
+				location += ":" + strconv.Itoa(frame.Colno)
+			}
+		}
+		if frame.Function != "" {
+			fmt.Fprintf(&b, "\n    at %s (%s)", frame.Function, location)
+		} else {
+			fmt.Fprintf(&b, "\n    at %s", location)
+		}
+	}
+	return b.String()
+}
+
+// culprit returns the frame an error is reported at: the innermost frame of
+// the application, or the innermost frame if none is marked as such.
+func culprit(frames []sentryFrame) (sentryFrame, bool) {
+	for i := len(frames) - 1; i >= 0; i-- {
+		if frames[i].InApp != nil && *frames[i].InApp {
+			return frames[i], true
+		}
+	}
+	if len(frames) == 0 {
+		return sentryFrame{}, false
+	}
+	return frames[len(frames)-1], true
+}
+
+// sentryErrorDetails maps a Sentry event onto an Overlord payload. Server
+// SDKs know nothing of the page, domain or user agent Overlord requires, so
+// those fall back to the server name and the SDK, and a missing line or
+// column to 1. It also returns the frames of the reported stack, outermost first.
+func sentryErrorDetails(event *sentryEvent, client string) (types.ErrorDetails, []sentryFrame) {
+	data := types.ErrorDetails{
+		Release:     event.Release,
+		Environment: event.Environment,
+		Extra:       event.Extra,
+	}
+
+	// The last exception is the one that was raised; earlier ones caused it
+	var frames []sentryFrame
+	if exceptions := sentryValues[sentryException](event.Exception); len(exceptions) > 0 {
+		exception := exceptions[len(exceptions)-1]
+		data.ErrorText = exception.Type
+		if exception.Value != "" {
+			data.ErrorText = strings.TrimPrefix(exception.Type+": "+exception.Value, ": ")
+		}
+		if exception.Stacktrace != nil {
+			frames = exception.Stacktrace.Frames
+		}
+	}
+	if data.ErrorText == "" {
+		// The message is a string or, like logentry, an object
+		var message string
+		var entry sentryLogEntry
+		if json.Unmarshal(event.Message, &message) != nil {
+			json.Unmarshal(event.Message, &entry)
+		}
+		if event.LogEntry != nil {
+			entry = *event.LogEntry
+		}
+		data.ErrorText = cmp.Or(message, entry.Formatted, entry.Message)
+	}
+	if frames == nil && event.Stacktrace != nil {
+		frames = event.Stacktrace.Frames
+	}
+	if len(frames) > 0 {
+		data.StackTrace = renderSentryStack(data.ErrorText, frames)
+	}
+
+	frame, ok := culprit(frames)
+	if !ok {
+		frame = sentryFrame{Filename: cmp.Or(event.Logger, event.Platform, "unknown")}
+	}
+	data.Filename = cmp.Or(frame.file(), "unknown")
+	data.Line = max(frame.Lineno, 1)
+	data.Column = max(frame.Colno, 1)
+
+	headers := map[string]string{}
+	if event.Request != nil {
+		data.URL = event.Request.URL
+		headers = sentryPairs(event.Request.Headers)
+	}
+	for key, value := range headers {
+		if strings.EqualFold(key, "User-Agent") {
+			data.UserAgent = value
+		}
+	}
+	if data.UserAgent == "" && event.SDK != nil && event.SDK.Name != "" {
+		data.UserAgent = event.SDK.Name + "/" + event.SDK.Version
+	}
+	data.UserAgent = cmp.Or(data.UserAgent, client, "sentry")
+
+	if u, err := url.Parse(data.URL); err == nil && u.Hostname() != "" {
+		data.Domain = u.Hostname()
+	} else {
+		data.Domain = cmp.Or(event.ServerName, "unknown")
+		data.URL = "https://" + data.Domain + "/"
+	}
+
+	when, ok := sentryTime(event.Timestamp)
+	if !ok {
+		when = time.Now().UTC()
+	}
+	data.Datetime = when.Format(time.RFC3339)
+
+	data.Tags = sentryPairs(event.Tags)
+	for key, value := range map[string]string{"level": event.Level, "logger": event.Logger, "platform": event.Platform} {
+		if _, ok := data.Tags[key]; !ok && value != "" {
+			data.Tags[key] = value
+		}
+	}
+	if len(event.User) > 0 {
+		if data.Extra == nil {
+			data.Extra = make(map[string]any)
+		}
+		data.Extra["user"] = event.User
+	}
+
+	for _, crumb := range sentryValues[sentryBreadcrumb](event.Breadcrumbs) {
+		breadcrumb := types.Breadcrumb{
+			Category: cmp.Or(crumb.Category, crumb.Type),
+			Message:  crumb.Message,
+			Level:    crumb.Level,
+			Data:     crumb.Data,
+		}
+		if t, ok := sentryTime(crumb.Timestamp); ok {
+			breadcrumb.Timestamp = t.Format(time.RFC3339Nano)
+		} else {
+			breadcrumb.Timestamp = data.Datetime
+		}
+		data.Breadcrumbs = append(data.Breadcrumbs, breadcrumb)
+	}
+
+	return data, frames
+}
+
+// sentryAuth returns the public key and client name a Sentry SDK sent in
+// the X-Sentry-Auth or Authorization header, or in the query string.
+func sentryAuth(r *http.Request) (key, client string) {
+	query := r.URL.Query()
+	key, client = query.Get("sentry_key"), query.Get("sentry_client")
+	for _, header := range []string{r.Header.Get("X-Sentry-Auth"), r.Header.Get("Authorization")} {
+		fields, ok := strings.CutPrefix(strings.TrimSpace(header), "Sentry ")
+		if !ok {
+			continue
+		}
+		for _, field := range strings.Split(fields, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch name {
+			case "sentry_key":
+				key = value
+			case "sentry_client":
+				client = value
+			}
+		}
+	}
+	return key, client
+}
+
+// dsnKey returns the public key of a DSN.
+func dsnKey(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil {
+		return ""
+	}
+	return u.User.Username()
+}
+
+var errEnvelopeInvalid = errors.New("invalid envelope")
+
+type envelopeItem struct {
+	Type    string
+	Payload []byte
+}
+
+// parseEnvelope splits a Sentry envelope into its header and items. Each
+// item is a JSON header line followed by a payload that is either as long
+// as the header's length or runs to the end of the line. Lengths come from
+// the client, so one that runs past the end of the body is rejected.
+func parseEnvelope(body []byte) (map[string]any, []envelopeItem, error) {
+	rest := body
+	readLine := func() ([]byte, bool) {
+		if len(rest) == 0 {
+			return nil, false
+		}
+		line, after, _ := bytes.Cut(rest, []byte("\n"))
+		rest = after
+		return bytes.TrimRight(line, "\r"), true
+	}
+
+	line, ok := readLine()
+	if !ok {
+		return nil, nil, errEnvelopeInvalid
+	}
+	var header map[string]any
+	if json.Unmarshal(line, &header) != nil {
+		return nil, nil, errEnvelopeInvalid
+	}
+
+	items := make([]envelopeItem, 0)
+	for {
+		line, ok := readLine()
+		if !ok {
+			break
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var itemHeader struct {
+			Type   string `json:"type"`
+			Length *int   `json:"length"`
+		}
+		if json.Unmarshal(line, &itemHeader) != nil {
+			return nil, nil, errEnvelopeInvalid
+		}
+
+		var payload []byte
+		if itemHeader.Length != nil {
+			length := *itemHeader.Length
+			if length < 0 || length > len(rest) {
+				return nil, nil, errEnvelopeInvalid
+			}
+			payload, rest = rest[:length], rest[length:]
+			// The payload may be followed by a newline
+			rest = bytes.TrimPrefix(rest, []byte("\n"))
+		} else {
+			payload, _ = readLine()
+		}
+		items = append(items, envelopeItem{Type: itemHeader.Type, Payload: payload})
+	}
+	return header, items, nil
+}
+
+// ingestSentryEvent runs a decoded Sentry event through the ingestion
+// pipeline and answers with its ID, as Sentry SDKs expect.
+func (router *Router) ingestSentryEvent(w http.ResponseWriter, property *WebProperty, payload []byte, client string) {
+	var event sentryEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		http.Error(w, "Error parsing JSON body", http.StatusBadRequest)
+		return
+	}
+
+	data, frames := sentryErrorDetails(&event, client)
+	prepared, errs := router.prepareEvent(property, data)
+	if len(errs) > 0 {
+		router.rejectEvent(w, property, errs)
+		return
+	}
+
+	// Keep the SDK's verdict on which frames belong to the application
+	if len(prepared.Frames) == len(frames) {
+		for i := range prepared.Frames {
+			if inApp := frames[len(frames)-1-i].InApp; inApp != nil {
+				prepared.Frames[i].InApp = *inApp
+			}
+		}
+	}
+
+	if !router.acceptEvent(w, property, prepared) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"id": event.EventID})
+}
+
+// admitSentryProject authenticates a Sentry request by its public key and
+// checks that the key belongs to the project in the path.
+func (router *Router) admitSentryProject(w http.ResponseWriter, r *http.Request, key string) (WebProperty, bool) {
+	property, ok := router.admitToken(w, r, key)
+	if !ok {
+		return property, false
+	}
+	if r.PathValue("project") != strconv.FormatUint(uint64(property.ID), 10) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return property, false
+	}
+	return property, true
+}
+
+func (router *Router) api_sentry_store(w http.ResponseWriter, r *http.Request) {
+	key, client := sentryAuth(r)
+	property, ok := router.admitSentryProject(w, r, key)
+	if !ok {
+		return
+	}
+
+	body, err := readBody(w, r, router.Limits.MaxBodyBytes)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	router.ingestSentryEvent(w, &property, body, client)
+}
+
+func (router *Router) api_sentry_envelope(w http.ResponseWriter, r *http.Request) {
+	// SDKs authenticate in a header or the query, so they are admitted
+	// before the body is read
+	key, client := sentryAuth(r)
+	var property WebProperty
+	if key != "" {
+		var ok bool
+		if property, ok = router.admitSentryProject(w, r, key); !ok {
+			return
+		}
+	}
+
+	body, err := readBody(w, r, router.Limits.MaxBodyBytes)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	header, items, err := parseEnvelope(body)
+	if err != nil {
+		http.Error(w, "Error parsing envelope", http.StatusBadRequest)
+		return
+	}
+
+	// Tunnelled envelopes carry their DSN in the header instead
+	if key == "" {
+		dsn, _ := header["dsn"].(string)
+		var ok bool
+		if property, ok = router.admitSentryProject(w, r, dsnKey(dsn)); !ok {
+			return
+		}
+	}
+
+	// Sessions, transactions, attachments and client reports are ignored
+	for _, item := range items {
+		if item.Type == "event" {
+			router.ingestSentryEvent(w, &property, item.Payload, client)
+			return
+		}
+	}
+
+	eventID, _ := header["event_id"].(string)
+	writeJSON(w, http.StatusOK, map[string]string{"id": eventID})
+}
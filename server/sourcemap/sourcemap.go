@@ -0,0 +1,196 @@
+// Package sourcemap reads version 3 source maps and maps positions in a
+// generated file back to their original source.
+package sourcemap
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Map is a parsed source map.
+type Map struct {
+	File    string
+	Sources []string
+	Names   []string
+	lines   [][]segment
+}
+
+// Mapping is the original position of a generated position. Line and Column
+// are 1-based, matching the positions browsers report.
+type Mapping struct {
+	Source string
+	Line   int
+	Column int
+	Name   string
+}
+
+type segment struct {
+	generatedColumn int
+	source          int
+	line            int
+	column          int
+	name            int
+}
+
+type rawMap struct {
+	Version    int               `json:"version"`
+	File       string            `json:"file"`
+	SourceRoot string            `json:"sourceRoot"`
+	Sources    []string          `json:"sources"`
+	Names      []string          `json:"names"`
+	Mappings   string            `json:"mappings"`
+	Sections   []json.RawMessage `json:"sections"`
+}
+
+// Parse decodes a source map and its mappings.
+func Parse(data []byte) (*Map, error) {
+	// Maps served over HTTP may be prefixed to prevent XSSI
+	data = []byte(strings.TrimPrefix(string(data), ")]}'"))
+
+	var raw rawMap
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	if raw.Version != 3 {
+		return nil, errors.New("sourcemap: only version 3 source maps are supported")
+	}
+	if len(raw.Sections) > 0 {
+		return nil, errors.New("sourcemap: indexed source maps are not supported")
+	}
+
+	m := &Map{
+		File:    raw.File,
+		Sources: make([]string, len(raw.Sources)),
+		Names:   raw.Names,
+	}
+	for i, source := range raw.Sources {
+		if raw.SourceRoot != "" && !strings.Contains(source, "://") && !strings.HasPrefix(source, "/") {
+			source = strings.TrimSuffix(raw.SourceRoot, "/") + "/" + source
+		}
+		m.Sources[i] = source
+	}
+
+	lines, err := decodeMappings(raw.Mappings, len(m.Sources), len(m.Names))
+	if err != nil {
+		return nil, err
+	}
+	m.lines = lines
+
+	return m, nil
+}
+
+// Lookup returns the original position of a 1-based line and column in the
+// generated file.
+func (m *Map) Lookup(line, column int) (Mapping, bool) {
+	if line < 1 || line > len(m.lines) {
+		return Mapping{}, false
+	}
+	segments := m.lines[line-1]
+	column--
+	if column < 0 {
+		column = 0
+	}
+
+	// Find the last segment starting at or before the column
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].generatedColumn > column
+	}) - 1
+	if i < 0 || segments[i].source < 0 {
+		return Mapping{}, false
+	}
+
+	seg := segments[i]
+	mapping := Mapping{
+		Source: m.Sources[seg.source],
+		Line:   seg.line + 1,
+		Column: seg.column + 1,
+	}
+	if seg.name >= 0 {
+		mapping.Name = m.Names[seg.name]
+	}
+	return mapping, true
+}
+
+func decodeMappings(mappings string, sources, names int) ([][]segment, error) {
+	lines := make([][]segment, 0)
+	current := make([]segment, 0)
+	var source, line, column, name int
+
+	for _, group := range strings.Split(mappings, ";") {
+		generatedColumn := 0
+		for _, field := range strings.Split(group, ",") {
+			if field == "" {
+				continue
+			}
+			values, err := decodeVLQ(field)
+			if err != nil {
+				return nil, err
+			}
+
+			generatedColumn += values[0]
+			seg := segment{generatedColumn: generatedColumn, source: -1, name: -1}
+			switch len(values) {
+			case 1:
+			case 4, 5:
+				source += values[1]
+				line += values[2]
+				column += values[3]
+				if source < 0 || source >= sources {
+					return nil, errors.New("sourcemap: mapping refers to an unknown source")
+				}
+				seg.source, seg.line, seg.column = source, line, column
+				if len(values) == 5 {
+					name += values[4]
+					if name < 0 || name >= names {
+						return nil, errors.New("sourcemap: mapping refers to an unknown name")
+					}
+					seg.name = name
+				}
+			default:
+				return nil, errors.New("sourcemap: invalid mapping segment")
+			}
+			current = append(current, seg)
+		}
+
+		sort.SliceStable(current, func(i, j int) bool {
+			return current[i].generatedColumn < current[j].generatedColumn
+		})
+		lines = append(lines, current)
+		current = make([]segment, 0)
+	}
+
+	return lines, nil
+}
+
+const base64Chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// decodeVLQ decodes a mapping segment of base64 VLQ values.
+func decodeVLQ(field string) ([]int, error) {
+	values := make([]int, 0, 5)
+	value, shift := 0, 0
+	for i := 0; i < len(field); i++ {
+		digit := strings.IndexByte(base64Chars, field[i])
+		if digit < 0 {
+			return nil, errors.New("sourcemap: invalid base64 VLQ character")
+		}
+		value += (digit & 31) << shift
+		if digit&32 != 0 {
+			shift += 5
+			continue
+		}
+
+		// The lowest bit is the sign
+		if value&1 != 0 {
+			values = append(values, -(value >> 1))
+		} else {
+			values = append(values, value>>1)
+		}
+		value, shift = 0, 0
+	}
+	if shift != 0 {
+		return nil, errors.New("sourcemap: truncated base64 VLQ value")
+	}
+	return values, nil
+}
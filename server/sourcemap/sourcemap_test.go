@@ -0,0 +1,66 @@
+package sourcemap
+
+import (
+	"testing"
+)
+
+// The example map from Mozilla's source-map library test suite
+const testMap = `{
+	"version": 3,
+	"file": "min.js",
+	"names": ["bar", "baz", "n"],
+	"sources": ["one.js", "two.js"],
+	"sourceRoot": "/the/root",
+	"mappings": "CAAC,IAAI,IAAM,SAAUA,GAClB,OAAOC,IAAID;CCDb,IAAI,IAAM,SAAUE,GAClB,OAAOA"
+}`
+
+func TestLookup(t *testing.T) {
+	m, err := Parse([]byte(testMap))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		line   int
+		column int
+		want   Mapping
+		wantOK bool
+	}{
+		{name: "first segment", line: 1, column: 2, want: Mapping{Source: "/the/root/one.js", Line: 1, Column: 2}, wantOK: true},
+		{name: "named segment", line: 1, column: 19, want: Mapping{Source: "/the/root/one.js", Line: 1, Column: 22, Name: "bar"}, wantOK: true},
+		{name: "between segments", line: 1, column: 30, want: Mapping{Source: "/the/root/one.js", Line: 2, Column: 11, Name: "baz"}, wantOK: true},
+		{name: "second source", line: 2, column: 2, want: Mapping{Source: "/the/root/two.js", Line: 1, Column: 2}, wantOK: true},
+		{name: "second source named", line: 2, column: 19, want: Mapping{Source: "/the/root/two.js", Line: 1, Column: 22, Name: "n"}, wantOK: true},
+		{name: "before first segment", line: 1, column: 1, wantOK: false},
+		{name: "line out of range", line: 3, column: 1, wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := m.Lookup(tt.line, tt.column)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("Lookup(%d, %d) = %+v, %v; want %+v, %v", tt.line, tt.column, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "not json", data: "nope"},
+		{name: "wrong version", data: `{"version": 2, "sources": [], "names": [], "mappings": ""}`},
+		{name: "indexed map", data: `{"version": 3, "sections": [{}]}`},
+		{name: "invalid vlq", data: `{"version": 3, "sources": ["a.js"], "names": [], "mappings": "A!AA"}`},
+		{name: "unknown source", data: `{"version": 3, "sources": ["a.js"], "names": [], "mappings": "ACAA"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse([]byte(tt.data)); err == nil {
+				t.Errorf("Parse() error = nil, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package stacktrace
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Go: "goroutine 1 [running]:", with the goroutine's state in brackets.
+	// GOTRACEBACK=system adds the g and m addresses.
+	goGoroutine = regexp.MustCompile(`^goroutine (\d+)(?: gp=\S+ m=\S+(?: mp=\S+)?)? \[(.*)\]:\s*$`)
+	// A frame is a function line, "pkg.(*T).Method(0xc000010000, {0x1, 0x2})"
+	// or "created by pkg.Func in goroutine 1", followed by a location line,
+	// "\t/path/to/file.go:42 +0x1d", which GOTRACEBACK=system extends with
+	// register values.
+	goCreatedBy = regexp.MustCompile(`^created by (\S+)(?: in goroutine \d+)?\s*$`)
+	goLocation  = regexp.MustCompile(`^\t(\S.*?):(\d+)(?: \+0x[0-9a-f]+)?(?: \w+=\S+)*\s*$`)
+)
+
+// Goroutine is one goroutine of a Go stack trace.
+type Goroutine struct {
+	ID int `json:"id"`
+	// Why the goroutine is not running, such as "chan receive, 2 minutes"
+	State string `json:"state"`
+	// The goroutine's frames, innermost first. The last frame of a goroutine
+	// started by a go statement is the statement's location, in the
+	// function that started it.
+	Frames []Frame `json:"frames"`
+}
+
+// ParseGo extracts the goroutines of a Go stack trace, as printed by an
+// unrecovered panic, debug.Stack or runtime.Stack. The goroutine that
+// panicked or called for the trace comes first. Frames that come without
+// a goroutine header, like those of a runtime.CallersFrames dump, are
+// returned as goroutine 0. It returns nothing if the trace has no Go
+// frames.
+func ParseGo(stack string) []Goroutine {
+	return parseGoroutines(stack, -1)
+}
+
+// parseGoroutines is ParseGo, stopping at the header that follows the
+// first limit goroutines with frames. A negative limit parses them all.
+func parseGoroutines(stack string, limit int) []Goroutine {
+	goroutines := make([]Goroutine, 0)
+	var current *Goroutine
+	parsed := 0
+	lines := strings.Split(strings.ReplaceAll(stack, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		if m := goGoroutine.FindStringSubmatch(lines[i]); m != nil {
+			if current != nil && len(current.Frames) > 0 {
+				parsed++
+			}
+			if limit >= 0 && parsed >= limit {
+				break
+			}
+			id, _ := strconv.Atoi(m[1])
+			goroutines = append(goroutines, Goroutine{ID: id, State: m[2], Frames: make([]Frame, 0)})
+			current = &goroutines[len(goroutines)-1]
+			continue
+		}
+		if i+1 >= len(lines) {
+			break
+		}
+		m := goLocation.FindStringSubmatch(lines[i+1])
+		if m == nil {
+			continue
+		}
+		function, ok := goFunction(lines[i])
+		if !ok {
+			continue
+		}
+
+		if current == nil {
+			goroutines = append(goroutines, Goroutine{Frames: make([]Frame, 0)})
+			current = &goroutines[len(goroutines)-1]
+		}
+		frame := Frame{Function: function, Filename: m[1]}
+		frame.Line, _ = strconv.Atoi(m[2])
+		frame.InApp = isGoInApp(frame.Function, frame.Filename)
+		current.Frames = append(current.Frames, frame)
+		i++
+	}
+
+	// Headers without frames, as in a trace cut off by a length limit, are
+	// left out
+	withFrames := goroutines[:0]
+	for _, goroutine := range goroutines {
+		if len(goroutine.Frames) > 0 {
+			withFrames = append(withFrames, goroutine)
+		}
+	}
+	return withFrames
+}
+
+// fromPanic leaves out the frames of a goroutine above its innermost call
+// to panic. Those are the deferred call that recovered from the panic and
+// asked for the trace, such as an error reporter's.
+func fromPanic(frames []Frame) []Frame {
+	for i, frame := range frames {
+		if frame.Function == "panic" {
+			return frames[i:]
+		}
+	}
+	return frames
+}
+
+// goFunction reads the function of a frame's function line, leaving out
+// its arguments.
+func goFunction(line string) (string, bool) {
+	if m := goCreatedBy.FindStringSubmatch(line); m != nil {
+		return m[1], true
+	}
+	line = strings.TrimRight(line, " \r")
+	if line == "" || line[0] == ' ' || line[0] == '\t' || !strings.HasSuffix(line, ")") {
+		return "", false
+	}
+	// Method receivers such as (*T) are parenthesized too, so the arguments
+	// are the last balanced parentheses
+	depth := 0
+	for i := len(line) - 1; i >= 0; i-- {
+		switch line[i] {
+		case ')':
+			depth++
+		case '(':
+			depth--
+			if depth == 0 {
+				return line[:i], i > 0
+			}
+		}
+	}
+	return "", false
+}
+
+// isGoInApp guesses whether a Go frame belongs to the application rather
+// than to the standard library or a module it depends on. Standard library
+// packages are told apart by living in their GOROOT directory, or at their
+// import path when built with -trimpath, as module paths need not contain a
+// dot.
+func isGoInApp(function, filename string) bool {
+	// Builtins such as panic have no package
+	if filename == "" || filename == "<autogenerated>" || !strings.Contains(function, ".") {
+		return false
+	}
+	if strings.Contains(filename, "/pkg/mod/") || strings.Contains(filename, "/vendor/") {
+		return false
+	}
+
+	pkg := goPackage(function)
+	first, _, _ := strings.Cut(pkg, "/")
+	if pkg == "main" || strings.Contains(first, ".") {
+		return true
+	}
+	// Standard library functions linked into the runtime, such as
+	// internal/poll.runtime_pollWait, are in its files
+	dir := path.Dir(filename)
+	for _, stdlib := range []string{pkg, "runtime"} {
+		if dir == stdlib || strings.HasSuffix(dir, "/src/"+stdlib) {
+			return false
+		}
+	}
+	return true
+}
+
+// goPackage returns the import path of a function's package:
+// "net/http.(*conn).serve" is in "net/http".
+func goPackage(function string) string {
+	slash := strings.LastIndexByte(function, '/') + 1
+	if dot := strings.IndexByte(function[slash:], '.'); dot >= 0 {
+		return function[:slash+dot]
+	}
+	return function
+}
@@ -0,0 +1,97 @@
+package stacktrace
+
+import (
+	"reflect"
+	"testing"
+)
+
+const goPanic = `panic: assignment to entry in nil map
+
+goroutine 34 [running]:
+example.com/shop/cart.(*Cart).Add(0xc000124000, {0x10308e4, 0x6}, 0x3)
+	/home/app/shop/cart/cart.go:42 +0x1d
+example.com/shop/cart.Handler.func1({0x1100a28, 0xc00014a000}, 0xc000156000)
+	/home/app/shop/cart/handler.go:17 +0x8c
+net/http.HandlerFunc.ServeHTTP(0xc000012345?, {0x1100a28?, 0xc00014a000?}, 0x0?)
+	/usr/local/go/src/net/http/server.go:2166 +0x29
+github.com/go-chi/chi/v5.(*Mux).ServeHTTP(0xc0000a4000, {0x1100a28, 0xc00014a000}, 0xc000156000)
+	/go/pkg/mod/github.com/go-chi/chi/v5@v5.0.12/mux.go:90 +0x2f3
+created by net/http.(*Server).Serve in goroutine 1
+	/usr/local/go/src/net/http/server.go:3285 +0x4b4
+
+goroutine 1 [IO wait, 2 minutes]:
+internal/poll.runtime_pollWait(0x7f3b2c1e8e80, 0x72)
+	/usr/local/go/src/runtime/netpoll.go:345 +0x85
+main.main()
+	/home/app/shop/main.go:25 +0x1f1
+exit status 2
+`
+
+func TestParseGo(t *testing.T) {
+	want := []Goroutine{
+		{ID: 34, State: "running", Frames: []Frame{
+			{Function: "example.com/shop/cart.(*Cart).Add", Filename: "/home/app/shop/cart/cart.go", Line: 42, InApp: true},
+			{Function: "example.com/shop/cart.Handler.func1", Filename: "/home/app/shop/cart/handler.go", Line: 17, InApp: true},
+			{Function: "net/http.HandlerFunc.ServeHTTP", Filename: "/usr/local/go/src/net/http/server.go", Line: 2166},
+			{Function: "github.com/go-chi/chi/v5.(*Mux).ServeHTTP", Filename: "/go/pkg/mod/github.com/go-chi/chi/v5@v5.0.12/mux.go", Line: 90},
+			{Function: "net/http.(*Server).Serve", Filename: "/usr/local/go/src/net/http/server.go", Line: 3285},
+		}},
+		{ID: 1, State: "IO wait, 2 minutes", Frames: []Frame{
+			{Function: "internal/poll.runtime_pollWait", Filename: "/usr/local/go/src/runtime/netpoll.go", Line: 345},
+			{Function: "main.main", Filename: "/home/app/shop/main.go", Line: 25, InApp: true},
+		}},
+	}
+	if got := ParseGo(goPanic); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseGo() = %+v, want %+v", got, want)
+	}
+	if got := parseGoroutines(goPanic, 1); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("parseGoroutines(1) = %+v, want only the first goroutine", got)
+	}
+	// A goroutine cut off before its frames does not count
+	if got := parseGoroutines("goroutine 9 [running]:\n\n"+goPanic, 1); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("parseGoroutines(1) = %+v, want the first goroutine with frames", got)
+	}
+	if got := Parse(goPanic); !reflect.DeepEqual(got, want[0].Frames) {
+		t.Errorf("Parse() = %+v, want the first goroutine's frames", got)
+	}
+}
+
+func TestParseGoFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		stack string
+		want  []Frame
+	}{
+		{
+			name:  "recovered panic",
+			stack: "goroutine 7 gp=0xc000007c00 m=0 mp=0x1234 [running]:\nruntime/debug.Stack()\n\t/usr/local/go/src/runtime/debug/stack.go:26 +0x5e\nmain.report({0x1034e40, 0x10c3c40})\n\t/app/main.go:30 +0x25\npanic({0x1034e40?, 0x10c3c40?})\n\t/usr/local/go/src/runtime/panic.go:770 +0x132 fp=0xc sp=0xc pc=0x1\ntjseabury/overlord/reporter.Map[...](...)\n\t/root/module/server/reporter/map.go:8\n...additional frames elided...\n",
+			want: []Frame{
+				{Function: "panic", Filename: "/usr/local/go/src/runtime/panic.go", Line: 770},
+				{Function: "tjseabury/overlord/reporter.Map[...]", Filename: "/root/module/server/reporter/map.go", Line: 8, InApp: true},
+			},
+		},
+		{
+			name:  "frames without a goroutine",
+			stack: "main.run(...)\n\t/app/main.go:12 +0x2a\r\nmain.main(...)\n\t/app/main.go:5 +0x10\n",
+			want: []Frame{
+				{Function: "main.run", Filename: "/app/main.go", Line: 12, InApp: true},
+				{Function: "main.main", Filename: "/app/main.go", Line: 5, InApp: true},
+			},
+		},
+		{
+			name:  "trimmed paths",
+			stack: "created by main.main\n\tmain.go:9 +0x3e\nsync.(*WaitGroup).Wait(0x0?)\n\tsync/waitgroup.go:116 +0x48\n",
+			want: []Frame{
+				{Function: "main.main", Filename: "main.go", Line: 9, InApp: true},
+				{Function: "sync.(*WaitGroup).Wait", Filename: "sync/waitgroup.go", Line: 116},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Parse(tt.stack); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
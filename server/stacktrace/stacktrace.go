@@ -0,0 +1,135 @@
+// Package stacktrace turns the stack trace strings reported by browsers and
+// Go programs into structured frames.
+package stacktrace
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Frame is a single call site of a stack trace.
+type Frame struct {
+	Function string `gorm:"not null" json:"function"`
+	Filename string `gorm:"not null" json:"filename"`
+	Line     int    `gorm:"not null" json:"line"`
+	Column   int    `gorm:"not null" json:"column"`
+	InApp    bool   `gorm:"not null" json:"inApp"`
+}
+
+var (
+	// V8 (Chrome, Edge, Node): "    at fn (file:1:2)" or "    at file:1:2"
+	v8Frame         = regexp.MustCompile(`^\s*at\s+(?:(.+?)\s+\((.+?)\)|(.+?))\s*$`)
+	v8EvalLocation  = regexp.MustCompile(`^eval at [^(]+ \((.+?)\)`)
+	v8AsyncFunction = regexp.MustCompile(`^(?:async|new)\s+`)
+	// SpiderMonkey (Firefox) and JavaScriptCore (Safari): "fn@file:1:2"
+	geckoFrame = regexp.MustCompile(`^\s*(.*?)@(.*?:\d+(?::\d+)?|\[native code\])\s*$`)
+	// JavaScriptCore also prints bare locations for anonymous code
+	bareLocation = regexp.MustCompile(`^\s*((?:[a-z][a-z0-9+.-]*:)?[^\s@()]+?):(\d+)(?::(\d+))?\s*$`)
+	location     = regexp.MustCompile(`^(.*?)(?::(\d+))?(?::(\d+))?$`)
+)
+
+// Parse extracts the frames of a V8, SpiderMonkey, JavaScriptCore or Go
+// stack trace, innermost first. Lines that are not frames, such as the
+// leading error message, are skipped. Of a Go trace listing several
+// goroutines, only the first, which panicked, is parsed, and its frames
+// are returned starting from the call to panic. The other goroutines are
+// not stored, so they are not parsed either; ParseGo returns them all.
+func Parse(stack string) []Frame {
+	if goroutines := parseGoroutines(stack, 1); len(goroutines) > 0 {
+		return fromPanic(goroutines[0].Frames)
+	}
+
+	frames := make([]Frame, 0)
+	for _, line := range strings.Split(stack, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if frame, ok := parseLine(line); ok {
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+func parseLine(line string) (Frame, bool) {
+	if m := v8Frame.FindStringSubmatch(line); m != nil {
+		return parseV8(m[1], m[2], m[3]), true
+	}
+
+	if m := geckoFrame.FindStringSubmatch(line); m != nil {
+		frame := parseLocation(m[2])
+		frame.Function = cleanFunction(m[1])
+		frame.InApp = IsInApp(frame.Filename)
+		return frame, true
+	}
+
+	if m := bareLocation.FindStringSubmatch(line); m != nil {
+		frame := Frame{Filename: m[1]}
+		frame.Line, _ = strconv.Atoi(m[2])
+		frame.Column, _ = strconv.Atoi(m[3])
+		frame.InApp = IsInApp(frame.Filename)
+		return frame, true
+	}
+
+	return Frame{}, false
+}
+
+func parseV8(function, loc, bare string) Frame {
+	if function == "" {
+		loc = bare
+	}
+	// "eval at fn (file:1:2), <anonymous>:3:4" points into eval'd code; the
+	// location of the eval call is the useful one.
+	if m := v8EvalLocation.FindStringSubmatch(loc); m != nil {
+		loc = m[1]
+	}
+
+	frame := parseLocation(loc)
+	frame.Function = cleanFunction(v8AsyncFunction.ReplaceAllString(function, ""))
+	frame.InApp = IsInApp(frame.Filename)
+	return frame
+}
+
+// parseLocation splits "file:line:column", where line and column are
+// optional and the file may itself contain colons (URLs).
+func parseLocation(loc string) Frame {
+	loc = strings.TrimSpace(loc)
+	m := location.FindStringSubmatch(loc)
+	frame := Frame{Filename: m[1]}
+	frame.Line, _ = strconv.Atoi(m[2])
+	frame.Column, _ = strconv.Atoi(m[3])
+	return frame
+}
+
+func cleanFunction(function string) string {
+	function = strings.TrimSpace(function)
+	// SpiderMonkey marks anonymous closures as "outer/<"
+	function = strings.TrimSuffix(function, "/<")
+	if function == "global code" || function == "<anonymous>" {
+		return ""
+	}
+	return function
+}
+
+// IsInApp guesses whether a file belongs to the application rather than to
+// a dependency, the browser or the runtime.
+func IsInApp(filename string) bool {
+	switch {
+	case filename == "",
+		filename == "<anonymous>",
+		filename == "native",
+		filename == "[native code]",
+		strings.Contains(filename, "/node_modules/"),
+		strings.HasPrefix(filename, "node_modules/"),
+		strings.HasPrefix(filename, "node:"),
+		strings.HasPrefix(filename, "internal/"),
+		strings.HasPrefix(filename, "chrome-extension:"),
+		strings.HasPrefix(filename, "moz-extension:"),
+		strings.HasPrefix(filename, "safari-extension:"),
+		strings.HasPrefix(filename, "safari-web-extension:"):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+package stacktrace
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		stack string
+		want  []Frame
+	}{
+		{
+			name:  "v8",
+			stack: "TypeError: Cannot read property 'map' of undefined\n    at processData (src/utils.js:10:7)\n    at src/components/ItemList.js:33:15\n    at Array.map (<anonymous>)\n    at async Object.getData (https://example.com:8080/static/app.js:14:5)\n    at new Widget (node_modules/widget/index.js:1:2)",
+			want: []Frame{
+				{Function: "processData", Filename: "src/utils.js", Line: 10, Column: 7, InApp: true},
+				{Function: "", Filename: "src/components/ItemList.js", Line: 33, Column: 15, InApp: true},
+				{Function: "Array.map", Filename: "<anonymous>", InApp: false},
+				{Function: "Object.getData", Filename: "https://example.com:8080/static/app.js", Line: 14, Column: 5, InApp: true},
+				{Function: "Widget", Filename: "node_modules/widget/index.js", Line: 1, Column: 2, InApp: false},
+			},
+		},
+		{
+			name:  "v8 eval",
+			stack: "Error: boom\n    at eval (eval at run (https://example.com/app.js:3:9), <anonymous>:1:7)",
+			want: []Frame{
+				{Function: "eval", Filename: "https://example.com/app.js", Line: 3, Column: 9, InApp: true},
+			},
+		},
+		{
+			name:  "v8 without columns",
+			stack: "at AuthController.login (auth_controller.go:42)\nat main.main (main.go:20)",
+			want: []Frame{
+				{Function: "AuthController.login", Filename: "auth_controller.go", Line: 42, InApp: true},
+				{Function: "main.main", Filename: "main.go", Line: 20, InApp: true},
+			},
+		},
+		{
+			name:  "spidermonkey",
+			stack: "render@https://example.com/app.js:10:7\nrun/<@https://example.com/app.js:22:3\n@https://example.com/app.js:30:1\nhandler@moz-extension://abc/content.js:1:1",
+			want: []Frame{
+				{Function: "render", Filename: "https://example.com/app.js", Line: 10, Column: 7, InApp: true},
+				{Function: "run", Filename: "https://example.com/app.js", Line: 22, Column: 3, InApp: true},
+				{Function: "", Filename: "https://example.com/app.js", Line: 30, Column: 1, InApp: true},
+				{Function: "handler", Filename: "moz-extension://abc/content.js", Line: 1, Column: 1, InApp: false},
+			},
+		},
+		{
+			name:  "javascriptcore",
+			stack: "render@https://example.com/app.js:10:7\nmap@[native code]\nglobal code@https://example.com/app.js:40:12\nhttps://example.com/app.js:50:2",
+			want: []Frame{
+				{Function: "render", Filename: "https://example.com/app.js", Line: 10, Column: 7, InApp: true},
+				{Function: "map", Filename: "[native code]", InApp: false},
+				{Function: "", Filename: "https://example.com/app.js", Line: 40, Column: 12, InApp: true},
+				{Function: "", Filename: "https://example.com/app.js", Line: 50, Column: 2, InApp: true},
+			},
+		},
+		{
+			name:  "message only",
+			stack: "Stack trace not available",
+			want:  []Frame{},
+		},
+		{
+			name:  "message containing an email address",
+			stack: "Error: invalid address user@example.com\n    at send (src/mail.js:4:2)",
+			want: []Frame{
+				{Function: "send", Filename: "src/mail.js", Line: 4, Column: 2, InApp: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Parse(tt.stack); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"tjseabury/overlord/types"
+)
+
+// Tag keys are identifiers such as "tenant_id" or "feature.checkout"
+var tagKeyRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// EventTag is a key/value tag of an event, indexed so events can be
+// filtered and counted by tag.
+type EventTag struct {
+	ID            uint   `gorm:"primarykey" json:"-"`
+	EventID       int    `gorm:"not null;index" json:"-"`
+	WebPropertyID uint   `gorm:"not null;index:idx_event_tag" json:"-"`
+	Key           string `gorm:"size:255;not null;index:idx_event_tag" json:"key"`
+	Value         string `gorm:"size:1024;not null;index:idx_event_tag" json:"value"`
+}
+
+// TagLimits bound the tags and extra context an event may carry. Events
+// over a limit are rejected rather than cut, as a partial tag is misleading.
+type TagLimits struct {
+	MaxTags        int
+	MaxKeyLength   int
+	MaxValueLength int
+	MaxExtraBytes  int
+}
+
+// Validate checks the tags and extra context of a payload against the
+// limits.
+func (l TagLimits) Validate(data *types.ErrorDetails) types.ValidationErrors {
+	var errs types.ValidationErrors
+	if l.MaxTags > 0 && len(data.Tags) > l.MaxTags {
+		errs = append(errs, types.FieldError{
+			Field:   "tags",
+			Code:    "tags.count",
+			Message: fmt.Sprintf("At most %d tags are allowed", l.MaxTags),
+		})
+	}
+
+	keys := make([]string, 0, len(data.Tags))
+	for key := range data.Tags {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		if !tagKeyRegex.MatchString(key) || (l.MaxKeyLength > 0 && len(key) > l.MaxKeyLength) {
+			errs = append(errs, types.FieldError{
+				Field:   "tags." + key,
+				Code:    "tags.key",
+				Message: fmt.Sprintf("Tag keys must be at most %d letters, digits or _.- characters", l.MaxKeyLength),
+			})
+			continue
+		}
+		if l.MaxValueLength > 0 && len(data.Tags[key]) > l.MaxValueLength {
+			errs = append(errs, types.FieldError{
+				Field:   "tags." + key,
+				Code:    "tags.value",
+				Message: fmt.Sprintf("Tag values must be at most %d bytes", l.MaxValueLength),
+			})
+		}
+	}
+
+	if l.MaxExtraBytes > 0 && len(data.Extra) > 0 {
+		if encoded, err := json.Marshal(data.Extra); err != nil || len(encoded) > l.MaxExtraBytes {
+			errs = append(errs, types.FieldError{
+				Field:   "extra",
+				Code:    "extra.size",
+				Message: fmt.Sprintf("Extra context must be at most %d bytes of JSON", l.MaxExtraBytes),
+			})
+		}
+	}
+	return errs
+}
+
+// tagsFor builds the tag table rows of an event, sorted by key.
+func tagsFor(propertyID uint, tags map[string]string) []EventTag {
+	rows := make([]EventTag, 0, len(tags))
+	for key, value := range tags {
+		rows = append(rows, EventTag{WebPropertyID: propertyID, Key: key, Value: value})
+	}
+	slices.SortFunc(rows, func(a, b EventTag) int { return strings.Compare(a.Key, b.Key) })
+	return rows
+}
+
+func (ec *EventController) ListTags(eventID int) []EventTag {
+	tags := make([]EventTag, 0)
+	ec.DB.Where("event_id = ?", eventID).Order("key").Find(&tags)
+	return tags
+}
@@ -1,48 +1,163 @@
+// Package types holds the payloads of Overlord's ingestion API. The Go
+// reporter imports it too, so it must not depend on the database.
 package types
 
 import (
 	"errors"
+	"fmt"
+	"net/url"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
+)
 
-	"gorm.io/gorm"
+// The types of event. Scripts report errors; the others are reports the
+// browser sends by itself through the Reporting API.
+const (
+	EventTypeError        = "error"
+	EventTypeDeprecation  = "deprecation"
+	EventTypeIntervention = "intervention"
+	EventTypeCrash        = "crash"
+	EventTypeCSPViolation = "csp-violation"
 )
 
+var eventTypes = []string{EventTypeError, EventTypeDeprecation, EventTypeIntervention, EventTypeCrash, EventTypeCSPViolation}
+
 type ErrorDetails struct {
-	Domain     string `gorm:"not null" json:"domain"`
-	ErrorText  string `gorm:"not null" json:"errorText"`
-	URL        string `gorm:"not null" json:"url"`
-	Filename   string `gorm:"not null" json:"filename"`
-	Line       int    `gorm:"not null" json:"line"`
-	Column     int    `gorm:"not null" json:"column"`
-	Datetime   string `gorm:"not null" json:"datetime"`
-	UserAgent  string `gorm:"not null" json:"userAgent"`
-	StackTrace string `gorm:"not null" json:"stackTrace"`
+	// One of the event types; empty means an error
+	Type        string `gorm:"size:32;not null;default:error;index" json:"type,omitempty"`
+	Domain      string `gorm:"not null" json:"domain"`
+	ErrorText   string `gorm:"not null" json:"errorText"`
+	URL         string `gorm:"not null" json:"url"`
+	Filename    string `gorm:"not null" json:"filename"`
+	Line        int    `gorm:"not null" json:"line"`
+	Column      int    `gorm:"not null" json:"column"`
+	Datetime    string `gorm:"not null" json:"datetime"`
+	UserAgent   string `gorm:"not null" json:"userAgent"`
+	StackTrace  string `gorm:"not null" json:"stackTrace"`
+	Release     string `gorm:"index" json:"release,omitempty"`
+	Environment string `gorm:"index" json:"environment,omitempty"`
+	// What happened on the page before the error, oldest first. Stored in
+	// a table of their own.
+	Breadcrumbs []Breadcrumb `gorm:"-" json:"breadcrumbs,omitempty"`
+	// Searchable key/value tags, such as a tenant ID or feature flag
+	// variant. Stored in a table of their own.
+	Tags map[string]string `gorm:"-" json:"tags,omitempty"`
+	// Free-form context that is stored and shown but not searchable
+	Extra map[string]any `gorm:"serializer:json" json:"extra,omitempty"`
+}
+
+// Breadcrumb is something that happened on the page before an error, such
+// as a navigation, click, network request or console message.
+type Breadcrumb struct {
+	Timestamp string         `gorm:"not null" json:"timestamp"`
+	Category  string         `gorm:"size:64;not null" json:"category"`
+	Message   string         `gorm:"not null" json:"message"`
+	Level     string         `gorm:"size:16;not null" json:"level"`
+	Data      map[string]any `gorm:"serializer:json" json:"data,omitempty"`
+}
+
+// The levels a breadcrumb may have; an empty level means info
+var breadcrumbLevels = map[string]string{
+	"":        "info",
+	"debug":   "debug",
+	"info":    "info",
+	"log":     "info",
+	"warn":    "warning",
+	"warning": "warning",
+	"error":   "error",
+	"fatal":   "fatal",
+}
+
+// SanitizeBreadcrumbs normalizes the breadcrumbs' timestamps, categories
+// and levels, returning an error for the first one that is invalid.
+func (e *ErrorDetails) SanitizeBreadcrumbs() error {
+	for i := range e.Breadcrumbs {
+		b := &e.Breadcrumbs[i]
+		field := fmt.Sprintf("breadcrumbs[%d]", i)
+
+		ts, err := time.Parse(time.RFC3339, strings.TrimSpace(b.Timestamp))
+		if err != nil {
+			return FieldError{Field: field + ".timestamp", Code: "breadcrumbs.timestamp", Message: "Breadcrumb timestamps must be RFC 3339 timestamps"}
+		}
+		b.Timestamp = ts.Format(time.RFC3339Nano)
+
+		level, ok := breadcrumbLevels[strings.ToLower(strings.TrimSpace(b.Level))]
+		if !ok {
+			return FieldError{Field: field + ".level", Code: "breadcrumbs.level", Message: "Breadcrumb level must be one of debug, info, warning, error or fatal"}
+		}
+		b.Level = level
+
+		b.Category = strings.TrimSpace(b.Category)
+		if b.Category == "" {
+			b.Category = "default"
+		}
+		if !labelRegex.MatchString(b.Category) || len(b.Category) > 64 {
+			return FieldError{Field: field + ".category", Code: "breadcrumbs.category", Message: "Breadcrumb categories must be at most 64 printable characters"}
+		}
+	}
+	return nil
+}
+
+// FieldError describes a single invalid field in an ErrorDetails payload.
+// Code is a stable, machine-readable identifier such as "domain.invalid".
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (fe FieldError) Error() string {
+	return "validation error: " + fe.Message
+}
+
+// ValidationErrors is the full list of problems found in a payload.
+type ValidationErrors []FieldError
+
+func (ve ValidationErrors) Error() string {
+	messages := make([]string, len(ve))
+	for i, fe := range ve {
+		messages[i] = fe.Message
+	}
+	return "validation error: " + strings.Join(messages, "; ")
 }
 
+// A hostname label: letters, digits and inner hyphens, at most 63 long
+var domainLabelRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
 func (e *ErrorDetails) SanitizeDomain() error {
 	e.Domain = strings.TrimSpace(e.Domain)
 	e.Domain = strings.TrimSuffix(e.Domain, ".")
 	e.Domain = strings.TrimPrefix(e.Domain, ".")
 
-	// Test against a regex pattern to ensure only valid cahracters are present
-	if matched, _ := regexp.MatchString(`^[a-zA-Z0-9][a-zA-Z0-9-.]{1,61}[a-zA-Z0-9]$`, e.Domain); !matched {
-		return errors.New("validation error: Domain is invalid")
+	// Every label must be a valid hostname label, and the name a valid length
+	invalid := FieldError{Field: "domain", Code: "domain.invalid", Message: "Domain is invalid"}
+	if len(e.Domain) < 3 || len(e.Domain) > 253 {
+		return invalid
+	}
+	for _, label := range strings.Split(e.Domain, ".") {
+		if !domainLabelRegex.MatchString(label) {
+			return invalid
+		}
 	}
 	return nil
 }
 
 func (e *ErrorDetails) SanitizeURL() error {
-	if matched, _ := regexp.MatchString(`^(https?:\/\/)?([\da-z\.-]+)\.([a-z\.]{2,6})([\/\w \.-]*)*\/?$`, e.URL); !matched {
-		return errors.New("validation error: URL is invalid")
+	e.URL = strings.TrimSpace(e.URL)
+	u, err := url.Parse(e.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return FieldError{Field: "url", Code: "url.invalid", Message: "URL is invalid"}
 	}
 	return nil
 }
 
 func (e *ErrorDetails) SanitizeFilename() error {
-	if matched, _ := regexp.MatchString(`^[^<>:"\\/|?*\x00-\x1F]+[^ .]$`, e.Filename); !matched {
-		return errors.New("validation error: Filename is invalid")
+	// Browsers report script URLs as filenames, so only reject characters
+	// that never appear in a path or URL.
+	if matched, _ := regexp.MatchString(`^[^<>"|*\x00-\x1F]*[^<>"|*\x00-\x1F .]$`, e.Filename); !matched {
+		return FieldError{Field: "filename", Code: "filename.invalid", Message: "Filename is invalid"}
 	}
 	return nil
 }
@@ -51,71 +166,117 @@ func (e *ErrorDetails) SanitizeDatetime() error {
 	e.Datetime = strings.TrimSpace(e.Datetime)
 	dt, err := time.Parse(time.RFC3339, e.Datetime)
 	if err != nil {
-		return errors.New("validation error: Datetime is invalid")
+		return FieldError{Field: "datetime", Code: "datetime.format", Message: "Datetime must be an RFC 3339 timestamp"}
 	}
 	e.Datetime = dt.Format(time.RFC3339)
 	return nil
 }
 
-func (e *ErrorDetails) SanitizeUserAgent() error {
-	// Test if the user agent mathes a common pattern, otherwise reject it.
-	if matched, _ := regexp.MatchString(`^Mozilla\/5\.0 \(Linux; U; Android (\d+\.)?(\d+\.)?(\*|\d+); [a-z]{2}-[a-z]{2}; (AFTA|AFTN|AFTS|AFTB|AFTT|AFTM|AFTKMST12|AFTRS) Build\/([A-Z0-9]+)\) AppleWebKit\/(\d+\.)?(\*|\d+) \(KHTML, like Gecko\) Version\/4\.0 Mobile Safari\/(\d+\.)?(\*|\d+)$`, e.UserAgent); !matched {
-		return errors.New("validation error: UserAgent is invalid")
-	}
+// Release and environment names are labels, so they are kept short and
+// printable.
+var labelRegex = regexp.MustCompile(`^[^\x00-\x1F\x7F]{1,255}$`)
+
+// User agents are free-form, but must be printable
+var userAgentRegex = regexp.MustCompile(`^[^\x00-\x1F\x7F]+$`)
 
+func (e *ErrorDetails) SanitizeRelease() error {
+	e.Release = strings.TrimSpace(e.Release)
+	if e.Release != "" && !labelRegex.MatchString(e.Release) {
+		return FieldError{Field: "release", Code: "release.invalid", Message: "Release must be at most 255 printable characters"}
+	}
 	return nil
 }
 
-func (e *ErrorDetails) ValidateFields() error {
-	if e.Domain == "" {
-		return errors.New("validation error: Domain is required")
-	}
-	if e.ErrorText == "" {
-		return errors.New("validation error: ErrorText is required")
-	}
-	if e.URL == "" {
-		return errors.New("validation error: URL is required")
+func (e *ErrorDetails) SanitizeEnvironment() error {
+	e.Environment = strings.ToLower(strings.TrimSpace(e.Environment))
+	if e.Environment != "" && !labelRegex.MatchString(e.Environment) {
+		return FieldError{Field: "environment", Code: "environment.invalid", Message: "Environment must be at most 255 printable characters"}
 	}
-	if e.Filename == "" {
-		return errors.New("validation error: Filename is required")
+	return nil
+}
+
+func (e *ErrorDetails) SanitizeType() error {
+	e.Type = strings.ToLower(strings.TrimSpace(e.Type))
+	if e.Type == "" {
+		e.Type = EventTypeError
 	}
-	if e.Line == 0 {
-		return errors.New("validation error: Line is required")
+	if !slices.Contains(eventTypes, e.Type) {
+		return FieldError{Field: "type", Code: "type.invalid", Message: "Type must be one of " + strings.Join(eventTypes, ", ")}
 	}
-	if e.Column == 0 {
-		return errors.New("validation error: Column is required")
+	return nil
+}
+
+func (e *ErrorDetails) SanitizeUserAgent() error {
+	e.UserAgent = strings.TrimSpace(e.UserAgent)
+	if len(e.UserAgent) > 1024 || !userAgentRegex.MatchString(e.UserAgent) {
+		return FieldError{Field: "userAgent", Code: "userAgent.invalid", Message: "UserAgent must be at most 1024 printable characters"}
 	}
-	if e.Datetime == "" {
-		return errors.New("validation error: Datetime is required")
+	return nil
+}
+
+// Validate checks and sanitizes every field, collecting all failures rather
+// than stopping at the first one.
+func (e *ErrorDetails) Validate() ValidationErrors {
+	var errs ValidationErrors
+
+	required := func(field string, missing bool, name string) bool {
+		if missing {
+			errs = append(errs, FieldError{Field: field, Code: field + ".required", Message: name + " is required"})
+		}
+		return !missing
 	}
-	if e.UserAgent == "" {
-		return errors.New("validation error: UserAgent is required")
+	sanitize := func(err error) {
+		var fe FieldError
+		if errors.As(err, &fe) {
+			errs = append(errs, fe)
+		}
 	}
 
-	if err := e.SanitizeDomain(); err != nil {
-		return err
+	sanitize(e.SanitizeType())
+	if required("domain", strings.TrimSpace(e.Domain) == "", "Domain") {
+		sanitize(e.SanitizeDomain())
+	}
+	required("errorText", e.ErrorText == "", "ErrorText")
+	if required("url", e.URL == "", "URL") {
+		sanitize(e.SanitizeURL())
 	}
-	if err := e.SanitizeURL(); err != nil {
-		return err
+	if required("filename", e.Filename == "", "Filename") {
+		sanitize(e.SanitizeFilename())
 	}
-	if err := e.SanitizeFilename(); err != nil {
-		return err
+	required("line", e.Line == 0, "Line")
+	required("column", e.Column == 0, "Column")
+	if required("datetime", e.Datetime == "", "Datetime") {
+		sanitize(e.SanitizeDatetime())
 	}
-	if err := e.SanitizeDatetime(); err != nil {
-		return err
+	if required("userAgent", e.UserAgent == "", "UserAgent") {
+		sanitize(e.SanitizeUserAgent())
 	}
-	// if err := e.SanitizeUserAgent(); err != nil {
-	// 	return err
-	// }
+	sanitize(e.SanitizeRelease())
+	sanitize(e.SanitizeEnvironment())
+	sanitize(e.SanitizeBreadcrumbs())
 
+	return errs
+}
+
+// ValidateFields runs Validate and returns its result as an error, or nil if
+// the payload is valid.
+func (e *ErrorDetails) ValidateFields() error {
+	if errs := e.Validate(); len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
-type ErrorDetailsModel struct {
-	ID        int            `gorm:"primaryKey" json:"id" tstype:"number|null"`
-	CreatedAt time.Time      `json:"created_at" tstype:"string|null"`
-	UpdatedAt time.Time      `json:"updated_at" tstype:"string|null"`
-	DeletedAt gorm.DeletedAt `gorm:"index" tstype:"null|string"`
-	ErrorDetails
-	WebPropertyID int `gorm:"not null" json:"web_property_id" tstype:"number|null"`
+// BatchItemResult reports whether a single item of a batch was accepted.
+type BatchItemResult struct {
+	Index    int              `json:"index"`
+	Accepted bool             `json:"accepted"`
+	Errors   ValidationErrors `json:"errors,omitempty"`
+}
+
+// BatchResult is the response body of the batch ingestion endpoint.
+type BatchResult struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []BatchItemResult `json:"results"`
 }
@@ -1,6 +1,7 @@
 package types
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -97,7 +98,27 @@ func TestSanitizeDomain(t *testing.T) {
 		},
 		{
 			name:    "invalid domain",
-			domain:  "example.com.au.uk.au.au.au.au.au.au.au.au.au.au.au.au",
+			domain:  "example..com",
+			wantErr: true,
+		},
+		{
+			name:    "invalid domain with leading hyphen",
+			domain:  "-example.com",
+			wantErr: true,
+		},
+		{
+			name:    "invalid domain with underscore",
+			domain:  "www_example.com",
+			wantErr: true,
+		},
+		{
+			name:    "invalid domain with long label",
+			domain:  strings.Repeat("a", 64) + ".com",
+			wantErr: true,
+		},
+		{
+			name:    "invalid domain too long",
+			domain:  strings.Repeat("example.", 32) + "com",
 			wantErr: true,
 		},
 	}
@@ -305,6 +326,47 @@ func TestSanitizeDatetime(t *testing.T) {
 	}
 }
 
+func TestSanitizeType(t *testing.T) {
+	tests := []struct {
+		name      string
+		eventType string
+		want      string
+		wantErr   bool
+	}{
+		{
+			name:      "empty type is an error",
+			eventType: "",
+			want:      EventTypeError,
+			wantErr:   false,
+		},
+		{
+			name:      "report type",
+			eventType: " CSP-Violation ",
+			want:      EventTypeCSPViolation,
+			wantErr:   false,
+		},
+		{
+			name:      "unknown type",
+			eventType: "warning",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &ErrorDetails{
+				Type: tt.eventType,
+			}
+			err := e.SanitizeType()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SanitizeType() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && e.Type != tt.want {
+				t.Errorf("SanitizeType() type = %q, want %q", e.Type, tt.want)
+			}
+		})
+	}
+}
+
 func TestSanitizeUserAgent(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -328,7 +390,12 @@ func TestSanitizeUserAgent(t *testing.T) {
 		},
 		{
 			name:      "invalid user agent",
-			userAgent: "Mozilla/5.0 (Linux; U; Android 10; en-us; Pixel 6 Pro Build/QP1A.190711.020; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/108.0.5359.125 Mobile Safari/537.36",
+			userAgent: "Mozilla/5.0 (Linux; U; Android 10)\x00",
+			wantErr:   true,
+		},
+		{
+			name:      "invalid user agent too long",
+			userAgent: "Mozilla/5.0 " + strings.Repeat("x", 1024),
 			wantErr:   true,
 		},
 		{
@@ -412,3 +479,27 @@ func TestValidateFields(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateCollectsAllErrors(t *testing.T) {
+	e := &ErrorDetails{
+		Domain:    "invalid domain.com",
+		ErrorText: "Error text",
+		URL:       "https://example.com",
+		Filename:  "example.txt",
+		Column:    2,
+		Datetime:  "2023-01-01T00:00:00",
+		UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:129.0) Gecko/20100101 Firefox/129.0",
+	}
+
+	errs := e.Validate()
+
+	wantCodes := []string{"domain.invalid", "line.required", "datetime.format"}
+	if len(errs) != len(wantCodes) {
+		t.Fatalf("Validate() returned %d errors, want %d: %v", len(errs), len(wantCodes), errs)
+	}
+	for i, code := range wantCodes {
+		if errs[i].Code != code {
+			t.Errorf("Validate() error %d code = %q, want %q", i, errs[i].Code, code)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Package useragent extracts the browser, operating system and device type
+// from User-Agent headers.
+package useragent
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Device types
+const (
+	Desktop = "desktop"
+	Mobile  = "mobile"
+	Tablet  = "tablet"
+	Bot     = "bot"
+	Unknown = "unknown"
+)
+
+// Agent is what could be learned from a user agent. Versions are cut to
+// major.minor, dropping a zero minor version, so they group usefully.
+type Agent struct {
+	Browser        string
+	BrowserVersion string
+	OS             string
+	OSVersion      string
+	Device         string
+	Bot            bool
+}
+
+type rule struct {
+	name  string
+	regex *regexp.Regexp
+}
+
+// Browsers are tried in order, as most user agents also claim to be the
+// browsers they were derived from.
+var browsers = []rule{
+	{"Edge", regexp.MustCompile(`Edg(?:e|A|iOS)?/([\d.]+)`)},
+	{"Opera", regexp.MustCompile(`(?:OPR|Opera)/([\d.]+)`)},
+	{"Samsung Internet", regexp.MustCompile(`SamsungBrowser/([\d.]+)`)},
+	{"Firefox", regexp.MustCompile(`(?:FxiOS|Firefox)/([\d.]+)`)},
+	{"Headless Chrome", regexp.MustCompile(`HeadlessChrome/([\d.]+)`)},
+	{"Chrome", regexp.MustCompile(`(?:CriOS|Chromium|Chrome)/([\d.]+)`)},
+	{"Safari", regexp.MustCompile(`Version/([\d.]+).*Safari/`)},
+	{"Internet Explorer", regexp.MustCompile(`(?:MSIE |Trident/.*rv:)([\d.]+)`)},
+}
+
+var systems = []rule{
+	{"Windows", regexp.MustCompile(`Windows NT ([\d.]+)`)},
+	{"iOS", regexp.MustCompile(`(?:iPhone|iPad|iPod).*? OS (\d+(?:_\d+)*)`)},
+	{"Android", regexp.MustCompile(`Android ([\d.]+)`)},
+	{"Chrome OS", regexp.MustCompile(`CrOS \S+ ([\d.]+)`)},
+	{"macOS", regexp.MustCompile(`Mac OS X (\d+(?:[_.]\d+)*)`)},
+	{"Linux", regexp.MustCompile(`Linux()`)},
+}
+
+// Marketing names of Windows NT versions; NT 10.0 covers Windows 11 too
+var windowsVersions = map[string]string{
+	"10.0": "10",
+	"6.3":  "8.1",
+	"6.2":  "8",
+	"6.1":  "7",
+	"6.0":  "Vista",
+	"5.1":  "XP",
+}
+
+var (
+	botRegex    = regexp.MustCompile(`(?i)bot\b|crawl|spider|slurp|facebookexternalhit|bingpreview|mediapartners|lighthouse|pingdom|uptimerobot`)
+	botName     = regexp.MustCompile(`(?i)(\w*(?:bot|crawler|spider))/([\d.]+)`)
+	tabletRegex = regexp.MustCompile(`iPad|Tablet|PlayBook|Silk/`)
+	mobileRegex = regexp.MustCompile(`Mobi|iPhone|iPod|Android`)
+)
+
+// shortVersion keeps the major and minor parts of a dotted version.
+func shortVersion(version string) string {
+	parts := strings.SplitN(strings.ReplaceAll(version, "_", "."), ".", 3)
+	if len(parts) == 1 || parts[1] == "0" || parts[1] == "" {
+		return parts[0]
+	}
+	return parts[0] + "." + parts[1]
+}
+
+func match(rules []rule, userAgent string) (string, string) {
+	for _, r := range rules {
+		if m := r.regex.FindStringSubmatch(userAgent); m != nil {
+			return r.name, m[1]
+		}
+	}
+	return "", ""
+}
+
+// Parse extracts what it can from a user agent. Unrecognized parts are left
+// empty and the device is Unknown.
+func Parse(userAgent string) Agent {
+	var agent Agent
+
+	if botRegex.MatchString(userAgent) {
+		agent.Bot = true
+		agent.Device = Bot
+		if m := botName.FindStringSubmatch(userAgent); m != nil {
+			agent.Browser = m[1]
+			agent.BrowserVersion = shortVersion(m[2])
+			return agent
+		}
+	}
+
+	if name, version := match(browsers, userAgent); name != "" {
+		agent.Browser = name
+		agent.BrowserVersion = shortVersion(version)
+	}
+
+	if name, version := match(systems, userAgent); name != "" {
+		agent.OS = name
+		switch name {
+		case "Windows":
+			if marketing, ok := windowsVersions[version]; ok {
+				version = marketing
+			}
+			agent.OSVersion = version
+		case "Linux":
+		default:
+			agent.OSVersion = shortVersion(version)
+		}
+	}
+
+	if agent.Device != "" {
+		return agent
+	}
+	switch {
+	case tabletRegex.MatchString(userAgent):
+		agent.Device = Tablet
+	case agent.OS == "Android" && !strings.Contains(userAgent, "Mobile"):
+		agent.Device = Tablet
+	case mobileRegex.MatchString(userAgent):
+		agent.Device = Mobile
+	case agent.OS != "":
+		agent.Device = Desktop
+	default:
+		agent.Device = Unknown
+	}
+	return agent
+}
@@ -0,0 +1,76 @@
+package useragent
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		want      Agent
+	}{
+		{
+			name:      "chrome on windows",
+			userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36",
+			want:      Agent{Browser: "Chrome", BrowserVersion: "129", OS: "Windows", OSVersion: "10", Device: Desktop},
+		},
+		{
+			name:      "edge on windows",
+			userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36 Edg/129.0.2792.79",
+			want:      Agent{Browser: "Edge", BrowserVersion: "129", OS: "Windows", OSVersion: "10", Device: Desktop},
+		},
+		{
+			name:      "firefox on linux",
+			userAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:129.0) Gecko/20100101 Firefox/129.0",
+			want:      Agent{Browser: "Firefox", BrowserVersion: "129", OS: "Linux", Device: Desktop},
+		},
+		{
+			name:      "safari on macos",
+			userAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Safari/605.1.15",
+			want:      Agent{Browser: "Safari", BrowserVersion: "17.5", OS: "macOS", OSVersion: "10.15", Device: Desktop},
+		},
+		{
+			name:      "safari on iphone",
+			userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_5_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1",
+			want:      Agent{Browser: "Safari", BrowserVersion: "17.5", OS: "iOS", OSVersion: "17.5", Device: Mobile},
+		},
+		{
+			name:      "chrome on ipad",
+			userAgent: "Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/120.0.6099.119 Mobile/15E148 Safari/604.1",
+			want:      Agent{Browser: "Chrome", BrowserVersion: "120", OS: "iOS", OSVersion: "16.6", Device: Tablet},
+		},
+		{
+			name:      "samsung internet on android phone",
+			userAgent: "Mozilla/5.0 (Linux; Android 13; SM-S901B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/25.0 Chrome/121.0.0.0 Mobile Safari/537.36",
+			want:      Agent{Browser: "Samsung Internet", BrowserVersion: "25", OS: "Android", OSVersion: "13", Device: Mobile},
+		},
+		{
+			name:      "chrome on android tablet",
+			userAgent: "Mozilla/5.0 (Linux; Android 12; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.0.0 Safari/537.36",
+			want:      Agent{Browser: "Chrome", BrowserVersion: "119", OS: "Android", OSVersion: "12", Device: Tablet},
+		},
+		{
+			name:      "internet explorer",
+			userAgent: "Mozilla/5.0 (Windows NT 6.1; Trident/7.0; rv:11.0) like Gecko",
+			want:      Agent{Browser: "Internet Explorer", BrowserVersion: "11", OS: "Windows", OSVersion: "7", Device: Desktop},
+		},
+		{
+			name:      "googlebot",
+			userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			want:      Agent{Browser: "Googlebot", BrowserVersion: "2.1", Device: Bot, Bot: true},
+		},
+		{
+			name:      "unknown",
+			userAgent: "curl/8.4.0",
+			want:      Agent{Device: Unknown},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Parse(tt.userAgent); got != tt.want {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// WebProperty is a site that is allowed to report errors to Overlord.
+// Every ingested event is stamped with the ID of the property whose
+// ingestion token it was sent with.
+type WebProperty struct {
+	ID             uint           `gorm:"primarykey" json:"id"`
+	CreatedAt      time.Time      `json:"createdAt"`
+	UpdatedAt      time.Time      `json:"updatedAt"`
+	DeletedAt      gorm.DeletedAt `gorm:"index" json:"-"`
+	Name           string         `gorm:"size:255;not null" json:"name"`
+	AllowedDomains []string       `gorm:"serializer:json" json:"allowedDomains"`
+	// Browser origins allowed to report errors; empty allows any
+	AllowedOrigins []string `gorm:"serializer:json" json:"allowedOrigins"`
+	Token          string   `gorm:"size:255;not null;uniqueIndex" json:"token"`
+	// The most events stored per UTC day; 0 means unlimited
+	DailyQuota int `gorm:"not null;default:0" json:"dailyQuota"`
+	// The fraction of events kept when no sampling rule matches
+	SampleRate    float64        `gorm:"not null;default:1" json:"sampleRate"`
+	SamplingRules []SamplingRule `gorm:"serializer:json" json:"samplingRules"`
+	Filters       InboundFilters `gorm:"serializer:json" json:"filters"`
+	Scrubbing     ScrubSettings  `gorm:"serializer:json" json:"scrubbing"`
+}
+
+// AllowsDomain reports whether events for the given domain may be recorded
+// against this property. A property with no allowed domains accepts any.
+func (p *WebProperty) AllowsDomain(domain string) bool {
+	if len(p.AllowedDomains) == 0 {
+		return true
+	}
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	for _, allowed := range p.AllowedDomains {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if domain == allowed {
+			return true
+		}
+		// "*.example.com" matches any subdomain of example.com
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(domain, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+type WebPropertyController struct {
+	DB *gorm.DB
+}
+
+func newWebPropertyDB(db *gorm.DB) WebPropertyController {
+	return WebPropertyController{DB: db}
+}
+
+func (pc *WebPropertyController) CreateWebProperty(p *WebProperty) (uint, error) {
+	if p.Token == "" {
+		token, err := GenerateSecureRandomToken()
+		if err != nil {
+			return 0, err
+		}
+		p.Token = token
+	}
+	tx := pc.DB.Create(p)
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	return p.ID, nil
+}
+
+func (pc *WebPropertyController) GetWebProperty(id uint) (WebProperty, error) {
+	var p WebProperty
+	pc.DB.First(&p, id)
+
+	if p.ID == 0 {
+		return p, errors.New("web property not found")
+	}
+
+	return p, nil
+}
+
+func (pc *WebPropertyController) ListWebProperties() []WebProperty {
+	properties := make([]WebProperty, 0)
+	pc.DB.Order("id").Find(&properties)
+	return properties
+}
+
+func (pc *WebPropertyController) UpdateWebProperty(p WebProperty) error {
+	return pc.DB.Save(&p).Error
+}
+
+func (pc *WebPropertyController) DeleteWebProperty(id uint) error {
+	return pc.DB.Delete(&WebProperty{}, id).Error
+}
+
+// FindByToken returns the property owning the given ingestion token.
+func (pc *WebPropertyController) FindByToken(token string) (WebProperty, error) {
+	var p WebProperty
+	if token == "" {
+		return p, errors.New("web property not found")
+	}
+	pc.DB.Where("token = ?", token).First(&p)
+
+	if p.ID == 0 {
+		return p, errors.New("web property not found")
+	}
+
+	return p, nil
+}
+
+type webPropertyForm struct {
+	Name           string          `json:"name"`
+	AllowedDomains []string        `json:"allowedDomains"`
+	AllowedOrigins []string        `json:"allowedOrigins"`
+	DailyQuota     *int            `json:"dailyQuota"`
+	SampleRate     *float64        `json:"sampleRate"`
+	SamplingRules  []SamplingRule  `json:"samplingRules"`
+	Filters        *InboundFilters `json:"filters"`
+	Scrubbing      *ScrubSettings  `json:"scrubbing"`
+}
+
+func (router *Router) webPropertyFromPath(w http.ResponseWriter, r *http.Request) (WebProperty, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid web property ID", http.StatusBadRequest)
+		return WebProperty{}, false
+	}
+	property, err := router.WebPropertyDB.GetWebProperty(uint(id))
+	if err != nil {
+		http.Error(w, "Web property not found", http.StatusNotFound)
+		return WebProperty{}, false
+	}
+	return property, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (router *Router) api_list_web_properties(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, router.WebPropertyDB.ListWebProperties())
+}
+
+func (router *Router) api_get_web_property(w http.ResponseWriter, r *http.Request) {
+	property, ok := router.webPropertyFromPath(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, property)
+}
+
+func (router *Router) api_create_web_property(w http.ResponseWriter, r *http.Request) {
+	var data webPropertyForm
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Error parsing JSON body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(data.Name) == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateSampling(data.SampleRate, data.SamplingRules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateFilters(data.Filters); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateScrubbing(data.Scrubbing); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	property := WebProperty{
+		Name:           strings.TrimSpace(data.Name),
+		AllowedDomains: data.AllowedDomains,
+		AllowedOrigins: data.AllowedOrigins,
+		SampleRate:     1,
+		SamplingRules:  data.SamplingRules,
+		Filters:        defaultInboundFilters(),
+	}
+	if data.Filters != nil {
+		property.Filters = *data.Filters
+	}
+	if data.Scrubbing != nil {
+		property.Scrubbing = *data.Scrubbing
+	}
+	if data.DailyQuota != nil {
+		property.DailyQuota = max(*data.DailyQuota, 0)
+	}
+	if data.SampleRate != nil {
+		property.SampleRate = *data.SampleRate
+	}
+	if _, err := router.WebPropertyDB.CreateWebProperty(&property); err != nil {
+		http.Error(w, "Error creating web property", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, property)
+}
+
+func (router *Router) api_update_web_property(w http.ResponseWriter, r *http.Request) {
+	property, ok := router.webPropertyFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var data webPropertyForm
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Error parsing JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := validateSampling(data.SampleRate, data.SamplingRules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateFilters(data.Filters); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateScrubbing(data.Scrubbing); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(data.Name) != "" {
+		property.Name = strings.TrimSpace(data.Name)
+	}
+	if data.AllowedDomains != nil {
+		property.AllowedDomains = data.AllowedDomains
+	}
+	if data.AllowedOrigins != nil {
+		property.AllowedOrigins = data.AllowedOrigins
+	}
+	if data.DailyQuota != nil {
+		property.DailyQuota = max(*data.DailyQuota, 0)
+	}
+	if data.SampleRate != nil {
+		property.SampleRate = *data.SampleRate
+	}
+	if data.SamplingRules != nil {
+		property.SamplingRules = data.SamplingRules
+	}
+	if data.Filters != nil {
+		property.Filters = *data.Filters
+	}
+	if data.Scrubbing != nil {
+		property.Scrubbing = *data.Scrubbing
+	}
+
+	if err := router.WebPropertyDB.UpdateWebProperty(property); err != nil {
+		http.Error(w, "Error updating web property", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, property)
+}
+
+func (router *Router) api_delete_web_property(w http.ResponseWriter, r *http.Request) {
+	property, ok := router.webPropertyFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := router.WebPropertyDB.DeleteWebProperty(property.ID); err != nil {
+		http.Error(w, "Error deleting web property", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{\"message\": \"Success\"}"))
+}